@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxClockSkew is how far the timestamp of a signed admin request may be
+// off from the server clock. Nonces are remembered for twice as long.
+const maxClockSkew = 5 * time.Minute
+
+// anonymous lets everyone in anonymously, which is how new managers
+// authenticate clients until they are given another function, e.g. one
+// built by tokenAuthenticator. Authenticators return the user id that
+// becomes the client id, or an empty id for anonymous clients, which are
+// given a random one. An error rejects the connection with 401.
+func anonymous(req *http.Request) (string, error) {
+	return "", nil
+}
+
+// errMissingToken is returned when a request carries no access token.
+var errMissingToken = errors.New("missing access token")
+
+// accessToken extracts the token from the Authorization header or, for
+// browsers which cannot set headers on websockets, the access_token query
+// parameter.
+func accessToken(req *http.Request) string {
+	if header := req.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimPrefix(header, "Bearer ")
+	}
+	return req.URL.Query().Get("access_token")
+}
+
+// tokenAuthenticator authenticates requests whose access token is one of
+// the keys of tokens, returning the user id it maps to.
+func tokenAuthenticator(tokens map[string]string) func(*http.Request) (string, error) {
+	return func(req *http.Request) (string, error) {
+		token := accessToken(req)
+		if token == "" {
+			return "", errMissingToken
+		}
+		userID, ok := tokens[token]
+		if !ok {
+			return "", errors.New("invalid access token")
+		}
+		return userID, nil
+	}
+}
+
+// loadTokens reads "<token> <user-id>" pairs, one per line, ignoring blank
+// lines and lines starting with #.
+func loadTokens(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	tokens := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a token and a user id", path, line)
+		}
+		tokens[fields[0]] = fields[1]
+	}
+	return tokens, scanner.Err()
+}
+
+// usedNonces remembers the nonces of recent admin requests, so each
+// of them is only accepted once.
+type usedNonces struct {
+	sync.Mutex
+	seen map[string]time.Time
+}
+
+// verifyAdminRequest checks the signature of a request to an admin
+// endpoint. The X-Timestamp header must hold the Unix time in seconds,
+// X-Nonce a value never used before and X-Signature the hex encoded
+// HMAC-SHA256, keyed with the broadcast secret, of the timestamp, a newline,
+// the nonce, another newline and the body. Stale timestamps
+// and reused nonces are rejected so captured requests cannot be replayed.
+func (manager *ClientManager) verifyAdminRequest(req *http.Request, body []byte) error {
+	if manager.broadcastSecret == "" {
+		return errors.New("admin requests are disabled")
+	}
+	timestamp, nonce := req.Header.Get("X-Timestamp"), req.Header.Get("X-Nonce")
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("missing or malformed timestamp")
+	}
+	if skew := time.Since(time.Unix(seconds, 0)); skew > maxClockSkew || skew < -maxClockSkew {
+		return errors.New("stale timestamp")
+	}
+	if nonce == "" {
+		return errors.New("missing nonce")
+	}
+	signature, err := hex.DecodeString(req.Header.Get("X-Signature"))
+	if err != nil {
+		return errors.New("malformed signature")
+	}
+	mac := hmac.New(sha256.New, []byte(manager.broadcastSecret))
+	mac.Write([]byte(timestamp + "\n" + nonce + "\n"))
+	mac.Write(body)
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return errors.New("invalid signature")
+	}
+
+	manager.nonces.Lock()
+	defer manager.nonces.Unlock()
+
+	now := time.Now()
+	for seen, expires := range manager.nonces.seen {
+		if now.After(expires) {
+			delete(manager.nonces.seen, seen)
+		}
+	}
+	if _, ok := manager.nonces.seen[nonce]; ok {
+		return errors.New("reused nonce")
+	}
+	manager.nonces.seen[nonce] = now.Add(2 * maxClockSkew)
+	return nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestTokenAuthenticator(t *testing.T) {
+	authenticate := tokenAuthenticator(map[string]string{"secret": "alice"})
+
+	req := httptest.NewRequest("GET", "/ws", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	if id, err := authenticate(req); err != nil || id != "alice" {
+		t.Errorf("authenticating with a bearer token = %q, %v, want alice", id, err)
+	}
+	if id, err := authenticate(httptest.NewRequest("GET", "/ws?access_token=secret", nil)); err != nil || id != "alice" {
+		t.Errorf("authenticating with access_token = %q, %v, want alice", id, err)
+	}
+	if _, err := authenticate(httptest.NewRequest("GET", "/ws?access_token=wrong", nil)); err == nil {
+		t.Error("an invalid token was accepted")
+	}
+	if _, err := authenticate(httptest.NewRequest("GET", "/ws", nil)); !errors.Is(err, errMissingToken) {
+		t.Errorf("authenticating without a token failed with %v, want %v", err, errMissingToken)
+	}
+}
+
+func TestInvalidTokensAreUnauthorized(t *testing.T) {
+	server := newTestServer(t, func(manager *ClientManager) {
+		manager.authenticate = tokenAuthenticator(map[string]string{"secret": "alice"})
+	})
+	if _, res, err := websocket.DefaultDialer.Dial(server.wsURL("access_token=wrong"), nil); err == nil || res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("dialing with an invalid token gave %v, want %d", err, http.StatusUnauthorized)
+	}
+	if client := server.dial(t, "access_token=secret"); client.id != "alice" {
+		t.Errorf("a valid token connected as %s, want alice", client.id)
+	}
+}
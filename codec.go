@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// msgpackSubprotocol is subprotocol spoken with MessagePack instead of JSON.
+const msgpackSubprotocol = subprotocol + "+msgpack"
+
+// Codec is the serialization a client speaks on the wire. Marshal and
+// Unmarshal convert messages, which are sent in frames of FrameType, and
+// Batch combines already encoded messages into an encoded array of them.
+type Codec interface {
+	Name() string
+	FrameType() int
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+	Batch(messages [][]byte) []byte
+}
+
+// jsonCodec is the default codec, sending JSON in text frames.
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string   { return "json" }
+func (jsonCodec) FrameType() int { return websocket.TextMessage }
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) Batch(messages [][]byte) []byte {
+	data := append([]byte{'['}, bytes.Join(messages, []byte{','})...)
+	return append(data, ']')
+}
+
+// msgpackCodec sends MessagePack in binary frames, which is more compact
+// than JSON for bandwidth sensitive clients. Fields keep their JSON names.
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string   { return "msgpack" }
+func (msgpackCodec) FrameType() int { return websocket.BinaryMessage }
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := msgpack.NewEncoder(&buf)
+	encoder.SetCustomStructTag("json")
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	decoder := msgpack.NewDecoder(bytes.NewReader(data))
+	decoder.SetCustomStructTag("json")
+	return decoder.Decode(v)
+}
+
+func (msgpackCodec) Batch(messages [][]byte) []byte {
+	var buf bytes.Buffer
+	msgpack.NewEncoder(&buf).EncodeArrayLen(len(messages))
+	for _, message := range messages {
+		buf.Write(message)
+	}
+	return buf.Bytes()
+}
+
+// codecs are the codecs clients may pick by name.
+var codecs = map[string]Codec{
+	"json":    jsonCodec{},
+	"msgpack": msgpackCodec{},
+}
+
+// negotiateCodec picks the codec for a new connection: MessagePack for
+// clients that negotiated msgpackSubprotocol, otherwise the one named by
+// the codec query parameter, JSON by default. wsPage rejects unknown names.
+func negotiateCodec(req *http.Request, protocol string) Codec {
+	if protocol == msgpackSubprotocol {
+		return msgpackCodec{}
+	}
+	if codec, ok := codecs[req.URL.Query().Get("codec")]; ok {
+		return codec
+	}
+	return jsonCodec{}
+}
+
+// envelope is a message on its way to clients, encoded at most once for
+// every codec the recipients speak. It is only used by one goroutine.
+type envelope struct {
+	message *Message
+	encoded map[Codec][]byte
+}
+
+// encode returns the message encoded with codec, encoding it on first use.
+func (env *envelope) encode(codec Codec) ([]byte, error) {
+	if data, ok := env.encoded[codec]; ok {
+		return data, nil
+	}
+	data, err := codec.Marshal(env.message)
+	if err != nil {
+		return nil, err
+	}
+	if env.encoded == nil {
+		env.encoded = make(map[Codec][]byte, 1)
+	}
+	env.encoded[codec] = data
+	return data, nil
+}
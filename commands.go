@@ -0,0 +1,306 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Command handles a slash command a client sent in m, with args the
+// words that followed the command name. The error it returns is sent back
+// to the client, with the code of a rejection or codeBadCommand for any
+// other error, except errClosing which ends the client's read loop.
+type Command func(c *Client, m *Message, args []string) error
+
+// command is a registered Command. A command taking up to maxArgs
+// arguments gets the rest of the line, as typed, in the last of them, e.g.
+// the text of a whisper, while one with maxArgs 0 gets all the words.
+// Only admins may run admin commands.
+type command struct {
+	run     Command
+	usage   string
+	maxArgs int
+	admin   bool
+}
+
+// errClosing is returned by commands after which the client goes away.
+var errClosing = errors.New("client is closing")
+
+// defaultCommands are the commands every new manager starts out with.
+// It is a function rather than a map so /help can list the commands
+// without an initialization cycle.
+func defaultCommands() map[string]command {
+	return map[string]command{
+		"help":        {run: helpCommand, usage: "/help"},
+		"quit":        {run: quitCommand, usage: "/quit"},
+		"join":        {run: joinCommand, usage: "/join [room] [password]", maxArgs: 2},
+		"subscribe":   {run: subscribeCommand, usage: "/subscribe <room> [password]", maxArgs: 2},
+		"unsubscribe": {run: unsubscribeCommand, usage: "/unsubscribe <room>", maxArgs: 1},
+		"who":         {run: whoCommand, usage: "/who"},
+		"whoami":      {run: whoamiCommand, usage: "/whoami"},
+		"rooms":       {run: roomsCommand, usage: "/rooms"},
+		"nick":        {run: nickCommand, usage: "/nick <name>", maxArgs: 1},
+		"me":          {run: meCommand, usage: "/me <action>", maxArgs: 1},
+		"whisper":     {run: whisperCommand, usage: "/whisper <nick> <text>", maxArgs: 2},
+		"kick":        {run: kickCommand, usage: "/kick <client-id>", maxArgs: 1, admin: true},
+		"kickroom":    {run: kickRoomCommand, usage: "/kickroom <room> [reason]", maxArgs: 2, admin: true},
+		"renameroom":  {run: renameRoomCommand, usage: "/renameroom <old> <new>", maxArgs: 2, admin: true},
+		"clear":       {run: clearCommand, usage: "/clear [room]", maxArgs: 1, admin: true},
+		"mute":        {run: muteCommand, usage: "/mute <client-id> <duration, e.g. 10m>", maxArgs: 2, admin: true},
+	}
+}
+
+// Handle registers a command under name, replacing any command of that
+// name. Like the other settings it must be called before the manager is
+// handed any clients.
+func (manager *ClientManager) Handle(name, usage string, run Command, maxArgs int, admin bool) {
+	manager.commands[name] = command{run: run, usage: usage, maxArgs: maxArgs, admin: admin}
+}
+
+// isCommand reports whether a chat message is a slash command.
+func isCommand(m *Message) bool {
+	return m.Type == "" && strings.HasPrefix(m.Content, "/")
+}
+
+// tokenize splits a slash command into its name and arguments, the last
+// of up to maxArgs of them holding the rest of the line. With maxArgs 0
+// every word is an argument.
+func tokenize(content string, maxArgs int) (string, []string) {
+	name, rest, _ := strings.Cut(strings.TrimPrefix(content, "/"), " ")
+	if maxArgs == 0 {
+		return name, strings.Fields(rest)
+	}
+	var args []string
+	for rest = strings.TrimSpace(rest); rest != "" && len(args) < maxArgs-1; rest = strings.TrimSpace(rest) {
+		var arg string
+		arg, rest, _ = strings.Cut(rest, " ")
+		args = append(args, arg)
+	}
+	if rest != "" {
+		args = append(args, rest)
+	}
+	return name, args
+}
+
+// dispatch runs the command a client sent. Text shortcuts such as /shrug
+// are no commands and are posted like any other message, unknown commands
+// are rejected.
+func (c *Client) dispatch(m *Message) error {
+	name, _ := tokenize(m.Content, 0)
+	cmd, ok := c.manager.commands[name]
+	if !ok {
+		if _, ok := shortcodes["/"+name]; ok {
+			c.post(m)
+			return nil
+		}
+		return reject(codeBadCommand, fmt.Sprintf("Unknown command /%s, see /help for the commands there are.", name))
+	}
+	if cmd.admin && !c.admin {
+		return reject(codeForbidden, "Permission denied: only admins may use /"+name+".")
+	}
+	_, args := tokenize(m.Content, cmd.maxArgs)
+	return cmd.run(c, m, args)
+}
+
+// sendCommandError tells the client why its command failed.
+func (manager *ClientManager) sendCommandError(conn *Client, err error) {
+	var r *rejection
+	if !errors.As(err, &r) {
+		err = reject(codeBadCommand, err.Error())
+	}
+	manager.sendRejection(conn, err)
+}
+
+// arg returns the i-th argument, or "" if there are fewer.
+func arg(args []string, i int) string {
+	if i < len(args) {
+		return args[i]
+	}
+	return ""
+}
+
+// usage rejects a command used the wrong way, showing how to use it.
+func usage(c *Client, name string) error {
+	return reject(codeBadCommand, "Usage: "+c.manager.commands[name].usage)
+}
+
+// changeRoom hands a room change to the manager, giving up once the
+// client is closing.
+func (c *Client) changeRoom(change *RoomChange) error {
+	select {
+	case c.manager.join <- change:
+		return nil
+	case <-c.ctx.Done():
+		return errClosing
+	}
+}
+
+// helpCommand lists the commands the client may use.
+func helpCommand(c *Client, m *Message, args []string) error {
+	var usages []string
+	for _, cmd := range c.manager.commands {
+		if !cmd.admin || c.admin {
+			usages = append(usages, cmd.usage)
+		}
+	}
+	sort.Strings(usages)
+	c.manager.reply(c, &Message{Content: "/Commands: " + strings.Join(usages, ", ")})
+	return nil
+}
+
+// quitCommand says goodbye for good, so the client cannot resume.
+func quitCommand(c *Client, m *Message, args []string) error {
+	c.quit.Store(true)
+	c.closeAfterDrain(websocket.CloseNormalClosure, "goodbye")
+	return errClosing
+}
+
+// joinCommand moves the client to a room, back to the default room
+// without one.
+func joinCommand(c *Client, m *Message, args []string) error {
+	room := arg(args, 0)
+	if room == "" {
+		room = defaultRoom
+	}
+	return c.changeRoom(&RoomChange{client: c, room: room, password: arg(args, 1)})
+}
+
+// subscribeCommand adds a room to those the client is in.
+func subscribeCommand(c *Client, m *Message, args []string) error {
+	if len(args) == 0 {
+		return usage(c, "subscribe")
+	}
+	return c.changeRoom(&RoomChange{client: c, room: args[0], password: arg(args, 1), mode: roomSubscribe})
+}
+
+// unsubscribeCommand takes the client out of one of its rooms.
+func unsubscribeCommand(c *Client, m *Message, args []string) error {
+	if len(args) == 0 {
+		return usage(c, "unsubscribe")
+	}
+	return c.changeRoom(&RoomChange{client: c, room: args[0], mode: roomUnsubscribe})
+}
+
+// whoCommand lists the connected clients, with details for admins.
+func whoCommand(c *Client, m *Message, args []string) error {
+	clients := c.manager.listClients(c.admin)
+	names := make([]string, len(clients))
+	for i, client := range clients {
+		names[i] = client.Name
+	}
+	c.manager.reply(c, &Message{Content: "/Online: " + strings.Join(names, ", "), Clients: clients})
+	return nil
+}
+
+// whoamiCommand repeats the client's id and nickname.
+func whoamiCommand(c *Client, m *Message, args []string) error {
+	me := c.manager.identity(c)
+	c.manager.reply(c, &Message{Recipient: me.ID, Name: me.Name, Status: me.Status, Content: "/You are " + me.Name + " with id " + me.ID + "."})
+	return nil
+}
+
+// roomsCommand lists the rooms and how many clients are in each.
+func roomsCommand(c *Client, m *Message, args []string) error {
+	rooms := c.manager.listRooms()
+	names := make([]string, 0, len(rooms))
+	for room, count := range rooms {
+		names = append(names, fmt.Sprintf("%s (%d)", room, count))
+	}
+	sort.Strings(names)
+	c.manager.reply(c, &Message{Content: "/Rooms: " + strings.Join(names, ", "), Rooms: rooms})
+	return nil
+}
+
+// nickCommand changes the client's nickname.
+func nickCommand(c *Client, m *Message, args []string) error {
+	return c.manager.rename(c, arg(args, 0))
+}
+
+// meCommand posts the message as an action, e.g. "/me waves".
+func meCommand(c *Client, m *Message, args []string) error {
+	if len(args) == 0 {
+		return usage(c, "me")
+	}
+	m.Type, m.Content = typeAction, args[0]
+	c.post(m)
+	return nil
+}
+
+// whisperCommand posts the message as a whisper to the client with the
+// given nickname.
+func whisperCommand(c *Client, m *Message, args []string) error {
+	if len(args) < 2 {
+		return usage(c, "whisper")
+	}
+	m.Type, m.Recipient, m.Content = typeWhisper, args[0], args[1]
+	c.post(m)
+	return nil
+}
+
+// kickCommand disconnects a client.
+func kickCommand(c *Client, m *Message, args []string) error {
+	if len(args) == 0 {
+		return usage(c, "kick")
+	}
+	if err := c.manager.kick(args[0]); err != nil {
+		return reject(codeNotFound, err.Error())
+	}
+	return nil
+}
+
+// kickRoomCommand disconnects everyone in a room.
+func kickRoomCommand(c *Client, m *Message, args []string) error {
+	if len(args) == 0 {
+		return usage(c, "kickroom")
+	}
+	reason := arg(args, 1)
+	if reason == "" {
+		reason = "kicked"
+	}
+	if err := c.manager.kickRoom(args[0], reason); err != nil {
+		return reject(codeNotFound, err.Error())
+	}
+	return nil
+}
+
+// renameRoomCommand gives a room a new name.
+func renameRoomCommand(c *Client, m *Message, args []string) error {
+	if len(args) < 2 || strings.Contains(args[1], " ") {
+		return usage(c, "renameroom")
+	}
+	if err := c.manager.renameRoom(args[0], args[1]); errors.Is(err, errNoSuchRoom) {
+		return reject(codeNotFound, err.Error())
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// clearCommand clears the history of a room, the current one by default.
+func clearCommand(c *Client, m *Message, args []string) error {
+	room := arg(args, 0)
+	if room == "" {
+		room = c.manager.currentRoom(c)
+	}
+	if room == "" {
+		return usage(c, "clear")
+	}
+	c.manager.clearHistory(room)
+	return nil
+}
+
+// muteCommand keeps a client from posting for a while.
+func muteCommand(c *Client, m *Message, args []string) error {
+	d, err := time.ParseDuration(arg(args, 1))
+	if len(args) < 2 || err != nil || d <= 0 {
+		return usage(c, "mute")
+	}
+	if err := c.manager.mute(args[0], d); err != nil {
+		return reject(codeNotFound, err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// deadLetterQueueSize is how many undelivered messages may wait to be
+// written by fileSink before further ones are dropped.
+const deadLetterQueueSize = 1024
+
+// DeadLetterSink is told about every message that could not be delivered,
+// such as direct messages to offline clients or broadcasts dropped for a
+// slow client. The manager calls it from several goroutines, often while
+// holding its lock, so implementations must be safe for concurrent use
+// and return quickly, see fileSink. Close is called on shutdown, once
+// the manager is done with the sink.
+type DeadLetterSink interface {
+	Undelivered(msg Message, reason string)
+	Close() error
+}
+
+// fileSink appends undelivered messages to a file as JSON lines, so
+// operators can inspect and later replay them. Like asyncStore it queues
+// the messages for a single goroutine to write, dropping them while
+// deadLetterQueueSize are waiting, so a slow disk never holds up delivery.
+type fileSink struct {
+	file    *os.File
+	logger  *slog.Logger
+	letters chan deadLetter
+	done    chan struct{}
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// deadLetter is a line written by fileSink.
+type deadLetter struct {
+	Time    time.Time `json:"time"`
+	Reason  string    `json:"reason"`
+	Message Message   `json:"message"`
+}
+
+// newFileSink opens the file at path for appending, creating it if needed,
+// and starts writing the queued messages to it.
+func newFileSink(path string, logger *slog.Logger) (*fileSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	sink := &fileSink{file: file, logger: logger, letters: make(chan deadLetter, deadLetterQueueSize), done: make(chan struct{})}
+	go sink.run()
+	return sink, nil
+}
+
+func (sink *fileSink) run() {
+	defer close(sink.done)
+	encoder := json.NewEncoder(sink.file)
+	for letter := range sink.letters {
+		if err := encoder.Encode(letter); err != nil {
+			sink.logger.Error("writing dead letter failed", "message", letter.Message.ID, "err", err)
+		}
+	}
+}
+
+// Undelivered queues the message and why it was not delivered, unless
+// the queue is full or the sink closed.
+func (sink *fileSink) Undelivered(msg Message, reason string) {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+
+	if sink.closed {
+		return
+	}
+	select {
+	case sink.letters <- deadLetter{Time: time.Now(), Reason: reason, Message: msg}:
+	default:
+		deadLettersDropped.Inc()
+	}
+}
+
+// Close writes the messages still queued and closes the file.
+func (sink *fileSink) Close() error {
+	sink.mu.Lock()
+	if !sink.closed {
+		sink.closed = true
+		close(sink.letters)
+	}
+	sink.mu.Unlock()
+
+	<-sink.done
+	return sink.file.Close()
+}
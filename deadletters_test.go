@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileSinkWritesQueuedLettersOnClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dead.jsonl")
+	sink, err := newFileSink(path, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"1", "2", "3"} {
+		sink.Undelivered(Message{ID: id}, "recipient offline")
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	sink.Undelivered(Message{ID: "4"}, "too late")
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var ids []string
+	for scanner := bufio.NewScanner(file); scanner.Scan(); {
+		var letter deadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &letter); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, letter.Message.ID)
+	}
+	if len(ids) != 3 || ids[0] != "1" || ids[2] != "3" {
+		t.Errorf("dead-letter file holds %v, want 1, 2 and 3 in order", ids)
+	}
+}
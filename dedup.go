@@ -0,0 +1,64 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// idempotencyKeys remembers, for dedupWindow, the idempotency keys of the
+// messages clients sent and the ids the server gave those messages, so a
+// message sent again by a client retrying over a flaky network is only
+// delivered once. Keys are remembered per client id, so they also match
+// when the retry comes in over a resumed connection. Expired keys are
+// swept once a window.
+type idempotencyKeys struct {
+	mu      sync.Mutex
+	seen    map[idempotencyKey]seenMessage
+	sweptAt time.Time
+}
+
+// idempotencyKey is a key as sent by the client with the given id.
+type idempotencyKey struct {
+	client string
+	key    string
+}
+
+// seenMessage is the message a key was first seen with.
+type seenMessage struct {
+	id string
+	at time.Time
+}
+
+func newIdempotencyKeys() *idempotencyKeys {
+	return &idempotencyKeys{seen: make(map[idempotencyKey]seenMessage), sweptAt: time.Now()}
+}
+
+// lookup returns the id of the message client sent with key within the
+// last dedupWindow, if any.
+func (keys *idempotencyKeys) lookup(client, key string) (string, bool) {
+	keys.mu.Lock()
+	defer keys.mu.Unlock()
+
+	seen, ok := keys.seen[idempotencyKey{client, key}]
+	if !ok || time.Since(seen.at) >= dedupWindow {
+		return "", false
+	}
+	return seen.id, true
+}
+
+// remember records that client sent the message with id under key.
+func (keys *idempotencyKeys) remember(client, key, id string) {
+	keys.mu.Lock()
+	defer keys.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(keys.sweptAt) >= dedupWindow {
+		for k, seen := range keys.seen {
+			if now.Sub(seen.at) >= dedupWindow {
+				delete(keys.seen, k)
+			}
+		}
+		keys.sweptAt = now
+	}
+	keys.seen[idempotencyKey{client, key}] = seenMessage{id: id, at: now}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// wordFilter matches the words that are masked in broadcast content.
+// It is nil while no word list is loaded, which disables filtering.
+var wordFilter *regexp.Regexp
+
+// loadWordList reads one word per line from the file at path, ignoring
+// blank lines and lines starting with #, and uses them for filterContent.
+func loadWordList(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var words []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		word := strings.TrimSpace(scanner.Text())
+		if word == "" || strings.HasPrefix(word, "#") {
+			continue
+		}
+		words = append(words, regexp.QuoteMeta(word))
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(words) == 0 {
+		wordFilter = nil
+		return nil
+	}
+	wordFilter = regexp.MustCompile(`(?i)\b(?:` + strings.Join(words, "|") + `)\b`)
+	return nil
+}
+
+// filterContent replaces every listed word in content with asterisks.
+// Matching is case-insensitive and only whole words are replaced.
+func filterContent(content string) string {
+	if wordFilter == nil {
+		return content
+	}
+	return wordFilter.ReplaceAllStringFunc(content, func(word string) string {
+		return strings.Repeat("*", utf8.RuneCountInString(word))
+	})
+}
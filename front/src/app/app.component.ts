@@ -8,6 +8,8 @@ import { SocketService } from "./socket.service";
 })
 export class AppComponent implements OnInit, OnDestroy {
 
+    private static hiddenTypes = new Set(["hello", "token", "ack", "typing", "presence", "history"]);
+
     public messages: Array<any>;
     public chatBox: string;
 
@@ -18,7 +20,9 @@ export class AppComponent implements OnInit, OnDestroy {
 
     public ngOnInit() {
         this.socket.getEventListener().subscribe(event => {
-            if(event.type == "message") {
+            // Typed messages such as the hello, tokens, acks and typing
+            // notifications are meant for the client, not the reader.
+            if(event.type == "message" && event.data.content && !AppComponent.hiddenTypes.has(event.data.type)) {
                 let data = event.data.content;
                 if(event.data.sender) {
                     data = event.data.sender + ": " + data;
@@ -46,7 +50,7 @@ export class AppComponent implements OnInit, OnDestroy {
     }
 
     public isSystemMessage(message: string) {
-        return message.startsWith("/") ? "<strong>" + message.substring(1) + "</strong>" : message;
+        return message && message.startsWith("/") ? "<strong>" + message.substring(1) + "</strong>" : message;
     }
 
 }
@@ -7,7 +7,7 @@ export class SocketService {
     private listener: EventEmitter<any> = new EventEmitter();
 
     public constructor() {
-        this.socket = new WebSocket("ws://localhost:4000/ws");
+        this.socket = new WebSocket("ws://localhost:4000/ws", "chat.v1");
         this.socket.onopen = event => {
             this.listener.emit({"type": "open", "data": event});
         }
@@ -15,7 +15,11 @@ export class SocketService {
             this.listener.emit({"type": "close", "data": event});
         }
         this.socket.onmessage = event => {
-            this.listener.emit({"type": "message", "data": JSON.parse(event.data)});
+            // The server batches queued messages into a JSON array.
+            let data = JSON.parse(event.data);
+            for (let message of Array.isArray(data) ? data : [data]) {
+                this.listener.emit({"type": "message", "data": message});
+            }
         }
     }
 
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// maxRequestBody is the largest request body the HTTP endpoints accept.
+const maxRequestBody = 64 << 10
+
+// startedAt is when the server started, reported as uptime by healthPage.
+var startedAt = time.Now()
+
+// handler routes the HTTP endpoints to this manager. Each manager gets
+// its own mux, so several of them can be served side by side, e.g. from
+// httptest servers.
+func (manager *ClientManager) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", manager.wsPage)
+	mux.HandleFunc("/healthz", manager.healthPage)
+	mux.HandleFunc("/stats", manager.statsPage)
+	mux.HandleFunc("/broadcast", manager.broadcastPage)
+	mux.HandleFunc("/clients", manager.clientsPage)
+	mux.HandleFunc("/upload", manager.uploadPage)
+	mux.Handle("/metrics", promhttp.Handler())
+	return mux
+}
+
+// healthPage lets load balancers probe the server without opening a websocket.
+// A draining server reports 503, so no new clients are sent its way.
+func (manager *ClientManager) healthPage(res http.ResponseWriter, req *http.Request) {
+	if !allowMethods(res, req, http.MethodGet, http.MethodHead) {
+		return
+	}
+	code, status := http.StatusOK, "ok"
+	if manager.draining.Load() {
+		code, status = http.StatusServiceUnavailable, "draining"
+	}
+	manager.writeJSON(res, code, map[string]interface{}{
+		"status":  status,
+		"uptime":  time.Since(startedAt).Round(time.Second).String(),
+		"clients": manager.count(),
+	})
+}
+
+// statsPage reports how many clients are connected, overall and per room.
+func (manager *ClientManager) statsPage(res http.ResponseWriter, req *http.Request) {
+	if !allowMethods(res, req, http.MethodGet, http.MethodHead) {
+		return
+	}
+	manager.writeJSON(res, http.StatusOK, manager.stats())
+}
+
+// broadcastPage pushes a system message, e.g. a maintenance notice, to every
+// connected client. It expects {"content":"..."} and optionally a "room" to
+// limit the message to, signed with the broadcast secret as checked by
+// verifyAdminRequest.
+func (manager *ClientManager) broadcastPage(res http.ResponseWriter, req *http.Request) {
+	if !allowMethods(res, req, http.MethodPost) {
+		return
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(res, req.Body, maxRequestBody))
+	if err != nil {
+		http.Error(res, "request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err := manager.verifyAdminRequest(req, data); err != nil {
+		manager.logger.Warn("rejecting admin request", "remote", manager.remoteAddr(req), "err", err)
+		http.Error(res, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var body struct {
+		Room    string `json:"room"`
+		Content string `json:"content"`
+	}
+	if err := json.Unmarshal(data, &body); err != nil {
+		http.Error(res, "malformed JSON body", http.StatusBadRequest)
+		return
+	}
+	if body.Content == "" || utf8.RuneCountInString(body.Content) > maxContentLength {
+		http.Error(res, "content must be between 1 and "+strconv.Itoa(maxContentLength)+" characters long", http.StatusBadRequest)
+		return
+	}
+
+	manager.broadcast <- &Message{Type: typeSystem, Room: body.Room, Content: "/" + body.Content}
+	res.WriteHeader(http.StatusAccepted)
+}
+
+// clientsPage reports the traffic of every connection to admins, whose
+// requests are signed just like those to broadcastPage.
+func (manager *ClientManager) clientsPage(res http.ResponseWriter, req *http.Request) {
+	if !allowMethods(res, req, http.MethodGet) {
+		return
+	}
+	if err := manager.verifyAdminRequest(req, nil); err != nil {
+		manager.logger.Warn("rejecting admin request", "remote", manager.remoteAddr(req), "err", err)
+		http.Error(res, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	manager.writeJSON(res, http.StatusOK, manager.connectionStats())
+}
+
+// allowMethods responds with 405 unless the request uses one of methods.
+func allowMethods(res http.ResponseWriter, req *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if req.Method == method {
+			return true
+		}
+	}
+	res.Header().Set("Allow", strings.Join(methods, ", "))
+	http.Error(res, "method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
+
+// writeJSON responds with the JSON encoding of body.
+func (manager *ClientManager) writeJSON(res http.ResponseWriter, status int, body interface{}) {
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	if err := json.NewEncoder(res).Encode(body); err != nil {
+		manager.logger.Warn("writing response failed", "err", err)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import "errors"
+
+// Interceptor inspects, and may rewrite, every message a client sends
+// before it is handled. It returns the message to pass on, or nil to drop
+// it silently. An error rejects the message: the interceptors after it
+// are skipped and the client is sent the error, with the code of a
+// rejection or codeBadMessage for any other error.
+type Interceptor func(c *Client, m *Message) (*Message, error)
+
+// rejection is an error telling the client which error code applies.
+type rejection struct {
+	code    string
+	message string
+}
+
+func (r *rejection) Error() string {
+	return r.message
+}
+
+// reject returns an error an interceptor can reject a message with.
+func reject(code, message string) error {
+	return &rejection{code: code, message: message}
+}
+
+// defaultInterceptors are installed on every new manager, in this order.
+// Mentions are looked up before filtering, so a mentioned nickname that
+// happens to be filtered still notifies its owner.
+var defaultInterceptors = []Interceptor{limitRate, findMentions, censor}
+
+// Use appends interceptor to the chain every inbound message runs
+// through. Like the other settings it must be called before the manager
+// is handed any clients.
+func (manager *ClientManager) Use(interceptor Interceptor) {
+	manager.interceptors = append(manager.interceptors, interceptor)
+}
+
+// intercept runs message through the interceptors in the order they were
+// added. It returns a nil message once one of them drops it.
+func (manager *ClientManager) intercept(c *Client, message *Message) (*Message, error) {
+	for _, interceptor := range manager.interceptors {
+		var err error
+		if message, err = interceptor(c, message); err != nil || message == nil {
+			return nil, err
+		}
+	}
+	return message, nil
+}
+
+// sendRejection tells the client why the interceptor chain rejected its message.
+func (manager *ClientManager) sendRejection(conn *Client, err error) {
+	var r *rejection
+	if errors.As(err, &r) {
+		manager.sendError(conn, r.code, r.message)
+		return
+	}
+	manager.sendError(conn, codeBadMessage, err.Error())
+}
+
+// limitRate rejects messages from clients sending faster than their
+// rate limiter allows.
+func limitRate(c *Client, m *Message) (*Message, error) {
+	if !c.limiter.Allow() {
+		return nil, reject(codeRateLimited, "You are sending messages too fast, slow down.")
+	}
+	return m, nil
+}
+
+// findMentions lists the clients mentioned in the content of a message.
+func findMentions(c *Client, m *Message) (*Message, error) {
+	m.Mentions = c.manager.mentions(m.Content)
+	return m, nil
+}
+
+// censor masks the words of the word list in the content of a message.
+func censor(c *Client, m *Message) (*Message, error) {
+	m.Content = filterContent(m.Content)
+	return m, nil
+}
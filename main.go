@@ -1,31 +1,499 @@
 package main
 
 import (
+	"compress/flate"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"flag"
 	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/netip"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/websocket"
 	uuid "github.com/satori/go.uuid"
 )
 
+// shutdownTimeout bounds how long we wait for the HTTP server to stop.
+const shutdownTimeout = 5 * time.Second
+
+// subprotocol is the versioned wire format spoken by this server.
+const subprotocol = "chat.v1"
+
 func main() {
-	fmt.Println("Starting application...")
+	// The ADDR environment variable replaces the default address,
+	// while an explicit -addr flag wins over both.
+	defaultAddr := ":4000"
+	if env := os.Getenv("ADDR"); env != "" {
+		defaultAddr = env
+	}
+	addr := flag.String("addr", defaultAddr, "address to listen on, defaults to $ADDR or :4000; empty serves -unix only")
+	unixSocket := flag.String("unix", "", "path of a Unix domain socket to serve on as well, e.g. for local sidecars")
+	manager := NewClientManager()
+	flag.IntVar(&manager.historySize, "history", defaultHistorySize, "number of recent messages kept per room and replayed to clients entering it")
+	flag.Float64Var(&manager.messageRate, "rate", defaultMessageRate, "messages per second a client may send, 0 disables rate limiting")
+	flag.IntVar(&manager.messageBurst, "burst", defaultMessageBurst, "number of messages a client may send in a single burst")
+	flag.StringVar(&manager.adminToken, "admin-token", "", "token that grants admin rights when passed as ?admin_token= on connect")
+	flag.IntVar(&manager.upgrader.ReadBufferSize, "read-buffer-size", 1024, "bytes buffered per connection for reading; larger buffers read big messages in fewer calls, smaller ones save memory with many clients")
+	flag.IntVar(&manager.upgrader.WriteBufferSize, "write-buffer-size", 1024, "bytes buffered per connection for writing; larger buffers write big messages in fewer frames, smaller ones save memory with many clients")
+	flag.DurationVar(&manager.upgrader.HandshakeTimeout, "handshake-timeout", 10*time.Second, "time allowed to complete the websocket handshake before the connection is dropped, 0 means no limit")
+	flag.BoolVar(&manager.upgrader.EnableCompression, "compress", false, "negotiate permessage-deflate compression with clients that support it")
+	flag.IntVar(&manager.compressionLevel, "compression-level", flate.BestSpeed, "flate compression level from -2 to 9 used with -compress")
+	flag.IntVar(&manager.compressionThreshold, "compression-threshold", 256, "messages smaller than this many bytes are sent uncompressed with -compress")
+	flag.BoolVar(&manager.requireSubprotocol, "require-subprotocol", false, "reject clients that do not request the "+subprotocol+" subprotocol")
+	origins := flag.String("allowed-origins", "*", "comma separated origins allowed to connect, * allows any origin")
+	originsFile := flag.String("allowed-origins-file", "", "file listing one allowed origin per line, replacing -allowed-origins and reloaded on SIGHUP")
+	secret := flag.String("token-secret", "", "secret used to sign reconnect tokens, random when empty")
+	flag.StringVar(&manager.broadcastSecret, "broadcast-secret", "", "secret signing requests to POST /broadcast and GET /clients, which are disabled when empty")
+	authFile := flag.String("auth-file", "", "file of \"<token> <user-id>\" lines; when set, clients must present a token")
+	wordList := flag.String("wordlist", "", "file with words to mask in messages, one per line")
+	shortcodesFile := flag.String("shortcodes", "", "file of \"<:name: or /name> <expansion>\" lines adding to the built-in shortcodes")
+	flag.IntVar(&manager.slowThreshold, "slow-threshold", defaultSlowThreshold, "number of sends in a row a client may miss before it is dropped as too slow")
+	flag.StringVar(&manager.overflowPolicy, "overflow-policy", overflowDisconnect, "what to do once a client's send queue is full: disconnect slow clients, drop-newest or drop-oldest")
+	flag.IntVar(&manager.maxClients, "max-clients", 0, "maximum number of connected clients, 0 means unlimited")
+	connectLimit := flag.Int("connect-limit", 0, "connections a single IP may open per -connect-window, 0 means unlimited")
+	connectWindow := flag.Duration("connect-window", time.Minute, "window -connect-limit applies to")
+	trustedProxies := flag.String("trusted-proxies", "", "comma separated IPs and CIDR ranges of proxies whose X-Forwarded-For header tells the client address")
+	queueSize := flag.Int("queue-size", defaultQueueSize, "number of messages that may wait for delivery before senders are held back")
+	flag.DurationVar(&manager.idleTimeout, "idle-timeout", 0, "disconnect clients that send no message or ping for this long, e.g. 10m, 0 disables it")
+	flag.StringVar(&manager.uploadDir, "upload-dir", "", "directory POST /upload stores attachments in, uploads are disabled when empty")
+	flag.Int64Var(&manager.maxUploadSize, "max-upload-size", defaultMaxUploadSize, "largest file in bytes accepted by POST /upload")
+	flag.BoolVar(&manager.includeSender, "include-sender", true, "send senders their own messages back, clients may override it with ?echo=true or ?echo=false")
+	flag.BoolVar(&manager.hideSpectators, "hide-spectators", false, "leave clients connected with ?spectate=true out of presence events and listings")
+	flag.DurationVar(&manager.presenceInterval, "presence-interval", 0, "how often every room is sent the full list of its occupants, e.g. 1m, 0 disables it")
+	dbFile := flag.String("db", "", "SQLite database messages are persisted to and history is restored from on startup, disabled when empty")
+	deadLetterFile := flag.String("dead-letter-file", "", "file undelivered messages are appended to as JSON lines, disabled when empty")
+	drainTimeout := flag.Duration("drain-timeout", 5*time.Minute, "how long SIGUSR1 waits for clients to leave before closing the rest and exiting")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate file, serves wss:// together with -tls-key")
+	tlsKey := flag.String("tls-key", "", "TLS private key file, serves wss:// together with -tls-cert")
+	logLevel := flag.String("log-level", "info", "minimum log level: debug, info, warn or error")
+	flag.Parse()
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid -log-level:", err)
+		os.Exit(2)
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+	manager.logger = logger
+
+	manager.setAllowedOrigins(parseOrigins(*origins))
+	if *originsFile != "" {
+		list, err := loadOrigins(*originsFile)
+		if err != nil {
+			logger.Error("loading the allowed origins failed", "path", *originsFile, "err", err)
+			os.Exit(2)
+		}
+		manager.setAllowedOrigins(list)
+
+		// SIGHUP picks up changes to the file without dropping anyone.
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		go func() {
+			for range reload {
+				manager.reloadOrigins(*originsFile)
+			}
+		}()
+	}
+	if *secret != "" {
+		manager.tokenSecret = []byte(*secret)
+	}
+	proxies, err := parseTrustedProxies(*trustedProxies)
+	if err != nil {
+		logger.Error("-trusted-proxies must list IP addresses or CIDR ranges", "proxies", *trustedProxies, "err", err)
+		os.Exit(2)
+	}
+	manager.trustedProxies = proxies
+	if *connectLimit > 0 {
+		if *connectWindow <= 0 {
+			logger.Error("-connect-window must be positive", "window", *connectWindow)
+			os.Exit(2)
+		}
+		manager.throttle = newConnectionThrottle(*connectLimit, *connectWindow)
+	}
+
+	if *authFile != "" {
+		tokens, err := loadTokens(*authFile)
+		if err != nil {
+			logger.Error("loading the auth file failed", "path", *authFile, "err", err)
+			os.Exit(2)
+		}
+		manager.authenticate = tokenAuthenticator(tokens)
+	}
+
+	if *wordList != "" {
+		if err := loadWordList(*wordList); err != nil {
+			logger.Error("loading the word list failed", "path", *wordList, "err", err)
+			os.Exit(2)
+		}
+	}
+	if *shortcodesFile != "" {
+		if err := loadShortcodes(*shortcodesFile); err != nil {
+			logger.Error("loading the shortcodes failed", "path", *shortcodesFile, "err", err)
+			os.Exit(2)
+		}
+	}
+
+	if manager.compressionThreshold < 0 {
+		logger.Error("-compression-threshold must not be negative", "threshold", manager.compressionThreshold)
+		os.Exit(2)
+	}
+	if manager.compressionLevel < flate.HuffmanOnly || manager.compressionLevel > flate.BestCompression {
+		logger.Error("-compression-level must be between -2 and 9", "level", manager.compressionLevel)
+		os.Exit(2)
+	}
+
+	switch manager.overflowPolicy {
+	case overflowDisconnect, overflowDropNewest, overflowDropOldest:
+	default:
+		logger.Error("-overflow-policy must be disconnect, drop-newest or drop-oldest", "policy", manager.overflowPolicy)
+		os.Exit(2)
+	}
+
+	if *queueSize < 0 {
+		logger.Error("-queue-size must not be negative", "size", *queueSize)
+		os.Exit(2)
+	}
+	manager.broadcast = make(chan *Message, *queueSize)
+
+	if *deadLetterFile != "" {
+		sink, err := newFileSink(*deadLetterFile, logger)
+		if err != nil {
+			logger.Error("opening the dead-letter file failed", "path", *deadLetterFile, "err", err)
+			os.Exit(2)
+		}
+		manager.deadLetters = sink
+	}
+
+	if *dbFile != "" {
+		store, err := openSQLiteStore(*dbFile)
+		if err != nil {
+			logger.Error("opening the database failed", "path", *dbFile, "err", err)
+			os.Exit(2)
+		}
+		manager.store = newAsyncStore(store, logger)
+		if err := manager.restore(); err != nil {
+			logger.Error("restoring history failed", "path", *dbFile, "err", err)
+			os.Exit(2)
+		}
+	}
+
+	if manager.maxUploadSize <= 0 {
+		logger.Error("-max-upload-size must be positive", "size", manager.maxUploadSize)
+		os.Exit(2)
+	}
+	if manager.uploadDir != "" {
+		if err := os.MkdirAll(manager.uploadDir, 0o755); err != nil {
+			logger.Error("creating the upload directory failed", "path", manager.uploadDir, "err", err)
+			os.Exit(2)
+		}
+	}
+
+	if manager.upgrader.ReadBufferSize < 0 || manager.upgrader.WriteBufferSize < 0 {
+		logger.Error("-read-buffer-size and -write-buffer-size must not be negative")
+		os.Exit(2)
+	}
+
+	if (*tlsCert == "") != (*tlsKey == "") {
+		logger.Error("both -tls-cert and -tls-key are required to serve TLS")
+		os.Exit(2)
+	}
+	useTLS := *tlsCert != ""
+	if *addr == "" && *unixSocket == "" {
+		logger.Error("-addr may only be empty with -unix")
+		os.Exit(2)
+	}
+
+	var unixListener net.Listener
+	if *unixSocket != "" {
+		listener, err := listenUnix(*unixSocket)
+		if err != nil {
+			logger.Error("listening on the Unix socket failed", "path", *unixSocket, "err", err)
+			os.Exit(2)
+		}
+		unixListener = listener
+	}
+
+	logger.Info("starting application", "addr", *addr, "unix", *unixSocket, "tls", useTLS)
 	go manager.start()
-	http.HandleFunc("/ws", wsPage)
-	http.ListenAndServe(":4000", nil)
+
+	server := &http.Server{Addr: *addr, Handler: manager.handler()}
+	errs := make(chan error, 2)
+	if *addr != "" {
+		go func() {
+			if useTLS {
+				errs <- server.ListenAndServeTLS(*tlsCert, *tlsKey)
+			} else {
+				errs <- server.ListenAndServe()
+			}
+		}()
+	}
+	// Local sidecars are trusted to share the host, so the Unix socket
+	// serves plain websockets even when TCP is served with TLS.
+	if unixListener != nil {
+		go func() {
+			errs <- server.Serve(unixListener)
+		}()
+	}
+
+	// Wait for an interrupt so the clients can be told we are leaving,
+	// instead of having their connections reset. SIGUSR1 first lets the
+	// connected clients leave on their own, for deploys without downtime.
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	drain := make(chan os.Signal, 1)
+	signal.Notify(drain, syscall.SIGUSR1)
+	select {
+	case err := <-errs:
+		logger.Error("server failed", "err", err)
+		os.Exit(1)
+	case <-stop:
+	case <-drain:
+		manager.awaitDrain(*drainTimeout, stop)
+	}
+
+	logger.Info("shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Warn("stopping the HTTP server failed", "err", err)
+	}
+	if *unixSocket != "" {
+		if err := os.Remove(*unixSocket); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logger.Warn("removing the Unix socket failed", "path", *unixSocket, "err", err)
+		}
+	}
+	manager.shutdown()
+	if manager.store != nil {
+		if err := manager.store.Close(); err != nil {
+			logger.Warn("closing the database failed", "err", err)
+		}
+	}
+	if manager.deadLetters != nil {
+		if err := manager.deadLetters.Close(); err != nil {
+			logger.Warn("closing the dead-letter file failed", "err", err)
+		}
+	}
 }
 
-// By adding a CheckOrigin we can accept requests from outside domains eliminating cross origin resource sharing (CORS) errors.
-func wsPage(res http.ResponseWriter, req *http.Request) {
-	conn, error := (&websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}).Upgrade(res, req, nil)
+// listenUnix listens on the Unix domain socket at path. A socket left
+// behind by a server that did not shut down cleanly is replaced, while
+// one that is still served, or any other file, makes listening fail.
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// wsPage upgrades the request to a websocket and registers the new client.
+// Compression is only used when the client negotiated permessage-deflate.
+func (manager *ClientManager) wsPage(res http.ResponseWriter, req *http.Request) {
+	if !hasSubprotocol(req) {
+		if manager.requireSubprotocol {
+			manager.logger.Warn("rejecting client without subprotocol", "remote", req.RemoteAddr, "requested", websocket.Subprotocols(req))
+			http.Error(res, "the "+subprotocol+" subprotocol is required", http.StatusBadRequest)
+			return
+		}
+		manager.logger.Info("client did not request subprotocol", "remote", req.RemoteAddr, "requested", websocket.Subprotocols(req))
+	}
+
+	if name := req.URL.Query().Get("codec"); name != "" && codecs[name] == nil {
+		http.Error(res, "unknown codec "+strconv.Quote(name)+", use json or msgpack", http.StatusBadRequest)
+		return
+	}
+
+	if manager.throttle != nil {
+		if ok, wait := manager.throttle.allow(manager.remoteAddr(req)); !ok {
+			manager.logger.Warn("rejecting client, too many connections", "remote", manager.remoteAddr(req))
+			res.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+			http.Error(res, "too many connections, try again later", http.StatusTooManyRequests)
+			return
+		}
+	}
+
+	if manager.draining.Load() {
+		manager.logger.Info("rejecting client while draining", "remote", req.RemoteAddr)
+		res.Header().Set("Retry-After", strconv.Itoa(int(retryAfter/time.Second)))
+		http.Error(res, "server is going away, try again later", http.StatusServiceUnavailable)
+		return
+	}
+
+	if manager.maxClients > 0 && manager.count() >= manager.maxClients {
+		manager.logger.Warn("rejecting client, server is full", "remote", req.RemoteAddr, "max", manager.maxClients)
+		res.Header().Set("Retry-After", strconv.Itoa(int(retryAfter/time.Second)))
+		http.Error(res, "too many clients, try again later", http.StatusServiceUnavailable)
+		return
+	}
+
+	userID, err := manager.authenticate(req)
+	if err != nil {
+		manager.logger.Info("rejecting unauthenticated client", "remote", req.RemoteAddr, "err", err)
+		http.Error(res, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Upgrade already responds with a suitable error status, e.g. 400 for
+	// plain HTTP requests, so all that is left to do on failure is logging.
+	conn, error := manager.upgrader.Upgrade(res, req, nil)
 	if error != nil {
-		http.NotFound(res, req)
+		manager.logger.Warn("websocket upgrade failed", "remote", req.RemoteAddr, "err", error)
 		return
 	}
-	client := &Client{id: uuid.NewV4().String(), socket: conn, send: make(chan []byte)}
+	connectionsTotal.Inc()
+	if manager.upgrader.EnableCompression {
+		conn.SetCompressionLevel(manager.compressionLevel)
+	}
+
+	id := userID
+	if id == "" {
+		id = uuid.NewV4().String()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	client := &Client{manager: manager, ctx: ctx, cancel: cancel, id: id, name: id, authenticated: userID != "", admin: manager.isAdmin(req), echo: manager.echo(req), readOnly: req.URL.Query().Get("spectate") == "true", protocol: conn.Subprotocol(), codec: negotiateCodec(req, conn.Subprotocol()), remoteAddr: manager.remoteAddr(req), userAgent: req.UserAgent(), socket: conn, send: make(chan frame, sendBufferSize), limiter: manager.limiter()}
+
+	// Clients coming back with a valid reconnect token get their previous
+	// identity back, everyone else starts with a fresh one. Authenticated
+	// clients may only resume their own sessions.
+	if token := req.URL.Query().Get("token"); token != "" {
+		if err := manager.resume(client, token); err != nil {
+			manager.logger.Info("not resuming client", "client", client.id, "err", err)
+		}
+	}
 
+	// The client is registered before its goroutines start, so start has
+	// handled the registration by the time read could unregister it, even
+	// if the client disconnects right away.
+	manager.writers.Add(1)
 	manager.register <- client
 
 	go client.read()
 	go client.write()
 }
+
+// awaitDrain stops accepting new clients and waits until the connected
+// ones have left, the timeout has passed or another signal arrives on stop.
+func (manager *ClientManager) awaitDrain(timeout time.Duration, stop <-chan os.Signal) {
+	manager.draining.Store(true)
+	manager.logger.Info("draining clients", "clients", manager.count(), "timeout", timeout)
+	deadline := time.After(timeout)
+	poll := time.NewTicker(time.Second)
+	defer poll.Stop()
+	for manager.count() > 0 {
+		select {
+		case <-poll.C:
+		case <-deadline:
+			manager.logger.Warn("drain timed out", "clients", manager.count())
+			return
+		case <-stop:
+			return
+		}
+	}
+}
+
+// isAdmin reports whether the request carries the configured admin token.
+// Nobody is an admin while no token is configured.
+func (manager *ClientManager) isAdmin(req *http.Request) bool {
+	token := req.URL.Query().Get("admin_token")
+	return manager.adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(manager.adminToken)) == 1
+}
+
+// remoteAddr returns the IP address of the client. X-Forwarded-For is
+// only believed when the request comes from one of the trusted proxies,
+// as anyone else could put any address there. The client is then the
+// last address in it that is no trusted proxy either, since proxies
+// append the address they got the request from to what the client sent.
+func (manager *ClientManager) remoteAddr(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	if !manager.trustedProxy(host) {
+		return host
+	}
+	forwarded := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(forwarded[i])
+		if addr == "" {
+			continue
+		}
+		host = addr
+		if !manager.trustedProxy(addr) {
+			break
+		}
+	}
+	return host
+}
+
+// trustedProxy reports whether addr is within one of the trusted proxies.
+func (manager *ClientManager) trustedProxy(addr string) bool {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return false
+	}
+	for _, proxy := range manager.trustedProxies {
+		if proxy.Contains(ip.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxies splits a comma separated list of IP addresses and
+// CIDR ranges, such as "10.0.0.0/8,127.0.0.1", dropping blanks.
+func parseTrustedProxies(list string) ([]netip.Prefix, error) {
+	var proxies []netip.Prefix
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, err
+			}
+			ip = ip.Unmap()
+			proxies = append(proxies, netip.PrefixFrom(ip, ip.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, err
+		}
+		proxies = append(proxies, prefix.Masked())
+	}
+	return proxies, nil
+}
+
+// echo decides whether a new client receives its own messages back: as
+// it asks with the echo query parameter, or as the deployment prefers.
+func (manager *ClientManager) echo(req *http.Request) bool {
+	if echo, err := strconv.ParseBool(req.URL.Query().Get("echo")); err == nil {
+		return echo
+	}
+	return manager.includeSender
+}
+
+// hasSubprotocol reports whether the client asked for one of our subprotocols.
+func hasSubprotocol(req *http.Request) bool {
+	for _, protocol := range websocket.Subprotocols(req) {
+		if protocol == subprotocol || protocol == msgpackSubprotocol {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestRemoteAddrTrustsOnlyConfiguredProxies(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.0/8, 192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager := NewClientManager()
+	manager.trustedProxies = proxies
+
+	tests := []struct {
+		remote, forwarded, want string
+	}{
+		{"203.0.113.7:5000", "", "203.0.113.7"},
+		{"203.0.113.7:5000", "198.51.100.1", "203.0.113.7"},
+		{"10.1.2.3:5000", "198.51.100.1", "198.51.100.1"},
+		{"192.0.2.1:5000", "198.51.100.1", "198.51.100.1"},
+		{"10.1.2.3:5000", "6.6.6.6, 198.51.100.1, 10.0.0.2", "198.51.100.1"},
+		{"10.1.2.3:5000", "", "10.1.2.3"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/ws", nil)
+		req.RemoteAddr = test.remote
+		if test.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		if got := manager.remoteAddr(req); got != test.want {
+			t.Errorf("remoteAddr from %s forwarding %q = %s, want %s", test.remote, test.forwarded, got, test.want)
+		}
+	}
+}
+
+func TestParseTrustedProxiesRejectsGarbage(t *testing.T) {
+	if _, err := parseTrustedProxies("10.0.0.0/8,proxy.local"); err == nil {
+		t.Error("parseTrustedProxies accepted a host name")
+	}
+}
+
+func TestConnectStormsFromOneIPAreThrottled(t *testing.T) {
+	const limit = 5
+	server := newTestServer(t, func(manager *ClientManager) {
+		manager.throttle = newConnectionThrottle(limit, time.Minute)
+		manager.trustedProxies, _ = parseTrustedProxies("127.0.0.0/8")
+	})
+	dial := func(ip string) *http.Response {
+		t.Helper()
+		conn, res, err := websocket.DefaultDialer.Dial(server.wsURL(""), http.Header{"X-Forwarded-For": {ip}})
+		if err == nil {
+			t.Cleanup(func() { conn.Close() })
+		} else if res == nil {
+			t.Fatalf("dialing as %s failed: %v", ip, err)
+		}
+		return res
+	}
+
+	for i := 0; i < limit; i++ {
+		if res := dial("198.51.100.1"); res.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("connection %d got status %d, want it accepted", i+1, res.StatusCode)
+		}
+	}
+	res := dial("198.51.100.1")
+	if res.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("connection %d got status %d, want %d", limit+1, res.StatusCode, http.StatusTooManyRequests)
+	}
+	if seconds, err := strconv.Atoi(res.Header.Get("Retry-After")); err != nil || seconds <= 0 {
+		t.Errorf("Retry-After is %q, want a positive number of seconds", res.Header.Get("Retry-After"))
+	}
+	if res := dial("198.51.100.2"); res.StatusCode != http.StatusSwitchingProtocols {
+		t.Errorf("another IP got status %d, want it accepted", res.StatusCode)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Operational metrics exposed on /metrics.
+var (
+	connectionsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "chat_connections_total",
+		Help: "Total number of accepted websocket connections.",
+	})
+	connectedClients = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "chat_connected_clients",
+		Help: "Number of currently connected clients.",
+	})
+	messagesReceived = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "chat_messages_received_total",
+		Help: "Total number of messages read from clients.",
+	})
+	messagesBroadcast = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "chat_messages_broadcast_total",
+		Help: "Total number of messages broadcast to a room.",
+	})
+	broadcastQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "chat_broadcast_queue_depth",
+		Help: "Number of messages waiting in the broadcast queue.",
+	})
+	messagesDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "chat_messages_dropped_total",
+		Help: "Total number of messages dropped because a client was too slow.",
+	})
+	overflowDrops = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "chat_send_queue_overflows_total",
+		Help: "Total number of messages dropped from or instead of a full send queue, by overflow policy.",
+	}, []string{"policy"})
+	deadLettersDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "chat_dead_letters_dropped_total",
+		Help: "Total number of undelivered messages the dead-letter file could not keep up with.",
+	})
+)
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// setAllowedOrigins replaces the Origin headers accepted on the websocket
+// handshake from now on. A single "*" entry accepts every origin, and so
+// does an allowlist that was never set. The list is replaced as a whole,
+// so a reload never leaves checkOrigin looking at half of it.
+func (manager *ClientManager) setAllowedOrigins(origins []string) {
+	manager.allowedOrigins.Store(&origins)
+}
+
+// parseOrigins splits a comma separated list of origins, dropping blanks.
+func parseOrigins(list string) []string {
+	var origins []string
+	for _, origin := range strings.Split(list, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
+
+// loadOrigins reads one origin per line, such as https://chat.example.com,
+// ignoring blank lines and lines starting with #. Anything that is neither
+// "*" nor a plain http or https origin makes the whole file invalid.
+func loadOrigins(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var origins []string
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		origin := strings.TrimSpace(scanner.Text())
+		if origin == "" || strings.HasPrefix(origin, "#") {
+			continue
+		}
+		if !validOrigin(origin) {
+			return nil, fmt.Errorf("%s:%d: %q is not an origin like https://example.com", path, line, origin)
+		}
+		origins = append(origins, origin)
+	}
+	return origins, scanner.Err()
+}
+
+// validOrigin reports whether origin is "*" or a scheme and host, with an
+// optional port, as browsers send them.
+func validOrigin(origin string) bool {
+	if origin == "*" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" && u.User == nil && u.Path == "" && u.RawQuery == "" && u.Fragment == ""
+}
+
+// reloadOrigins swaps in the origins listed in the file at path. A file
+// that fails to load keeps the current origins in place.
+func (manager *ClientManager) reloadOrigins(path string) {
+	origins, err := loadOrigins(path)
+	if err != nil {
+		manager.logger.Error("reloading the allowed origins failed, keeping the current ones", "path", path, "err", err)
+		return
+	}
+	manager.setAllowedOrigins(origins)
+	manager.logger.Info("reloaded the allowed origins", "path", path, "origins", len(origins))
+}
+
+// checkOrigin accepts requests without an Origin header, which come from
+// same-origin or non-browser clients, and those whose origin is allowed.
+func (manager *ClientManager) checkOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	origins := manager.allowedOrigins.Load()
+	if origins == nil {
+		return true
+	}
+	for _, allowed := range *origins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
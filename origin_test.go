@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestCheckOrigin(t *testing.T) {
+	manager := NewClientManager()
+	request := func(origin string) *http.Request {
+		req := httptest.NewRequest("GET", "/ws", nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		return req
+	}
+	if !manager.checkOrigin(request("https://anywhere.example")) {
+		t.Error("an origin was rejected before any allowlist was set")
+	}
+
+	manager.setAllowedOrigins([]string{"https://chat.example.com"})
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"", true},
+		{"https://chat.example.com", true},
+		{"HTTPS://Chat.Example.com", true},
+		{"https://evil.example.com", false},
+		{"http://chat.example.com", false},
+	}
+	for _, test := range tests {
+		if got := manager.checkOrigin(request(test.origin)); got != test.want {
+			t.Errorf("checkOrigin(%q) = %v, want %v", test.origin, got, test.want)
+		}
+	}
+
+	manager.setAllowedOrigins([]string{"*"})
+	if !manager.checkOrigin(request("https://evil.example.com")) {
+		t.Error("* did not allow every origin")
+	}
+}
+
+func TestDisallowedOriginsCannotConnect(t *testing.T) {
+	server := newTestServer(t, func(manager *ClientManager) {
+		manager.setAllowedOrigins([]string{"https://chat.example.com"})
+	})
+	header := http.Header{"Origin": {"https://evil.example.com"}}
+	if _, res, err := websocket.DefaultDialer.Dial(server.wsURL(""), header); err == nil || res.StatusCode != http.StatusForbidden {
+		t.Errorf("dialing from a disallowed origin gave %v, want %d", err, http.StatusForbidden)
+	}
+	header.Set("Origin", "https://chat.example.com")
+	conn, _, err := websocket.DefaultDialer.Dial(server.wsURL(""), header)
+	if err != nil {
+		t.Fatalf("dialing from an allowed origin failed: %v", err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// shortcodes maps emoji shortcodes such as ":smile:" and text shortcuts
+// such as "/shrug" to what they expand to. Text shortcuts only expand at
+// the start of a message, see expandShortcodes.
+var shortcodes = map[string]string{
+	"/shrug":       `¯\_(ツ)_/¯`,
+	"/tableflip":   "(╯°□°)╯︵ ┻━┻",
+	"/unflip":      "┬─┬ノ( º _ ºノ)",
+	":shrug:":      `¯\_(ツ)_/¯`,
+	":smile:":      "😄",
+	":laughing:":   "😆",
+	":wink:":       "😉",
+	":cry:":        "😢",
+	":heart:":      "❤️",
+	":thumbsup:":   "👍",
+	":+1:":         "👍",
+	":thumbsdown:": "👎",
+	":-1:":         "👎",
+	":tada:":       "🎉",
+	":wave:":       "👋",
+	":fire:":       "🔥",
+	":eyes:":       "👀",
+}
+
+// shortcodePattern matches emoji shortcodes.
+var shortcodePattern = regexp.MustCompile(`:[a-z0-9_+-]+:`)
+
+// loadShortcodes reads "<shortcode> <expansion>" lines from the file at
+// path, ignoring blank lines and lines starting with #, and adds them to
+// the shortcodes, replacing built-in ones of the same name. Shortcodes are
+// either ":name:" or "/name".
+func loadShortcodes(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	loaded := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		code, expansion, _ := strings.Cut(line, " ")
+		expansion = strings.TrimSpace(expansion)
+		if expansion == "" || !validShortcode(code) {
+			return fmt.Errorf("line %d: expected \"<:name: or /name> <expansion>\"", n)
+		}
+		loaded[code] = expansion
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	for code, expansion := range loaded {
+		shortcodes[code] = expansion
+	}
+	return nil
+}
+
+// validShortcode reports whether code is a ":name:" or "/name" shortcode.
+func validShortcode(code string) bool {
+	if strings.HasPrefix(code, "/") {
+		return len(code) > 1 && !strings.Contains(code[1:], "/")
+	}
+	return shortcodePattern.FindString(code) == code
+}
+
+// expandShortcodes replaces the emoji shortcodes in content with what
+// they stand for and expands a text shortcut the content starts with,
+// appending it to the rest of the message like "/shrug oh well" becomes
+// "oh well ¯\_(ツ)_/¯". Unknown shortcodes are left alone. It runs on
+// every message, so content without a colon or slash is returned as is.
+func expandShortcodes(content string) string {
+	if !strings.ContainsAny(content, ":/") {
+		return content
+	}
+	if strings.HasPrefix(content, "/") {
+		code, rest, _ := strings.Cut(content, " ")
+		if expansion, ok := shortcodes[code]; ok {
+			content = strings.TrimSpace(rest + " " + expansion)
+		}
+	}
+	if !strings.Contains(content, ":") {
+		return content
+	}
+	return shortcodePattern.ReplaceAllStringFunc(content, func(code string) string {
+		if expansion, ok := shortcodes[code]; ok {
+			return expansion
+		}
+		return code
+	})
+}
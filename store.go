@@ -0,0 +1,334 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"sync"
+
+	_ "modernc.org/sqlite"
+)
+
+// storeQueueSize is how many writes may wait for the message store before
+// further ones are dropped.
+const storeQueueSize = 1024
+
+// errStoreBusy is returned when the write queue of a store is full.
+var errStoreBusy = errors.New("message store is not keeping up")
+
+// MessageStore keeps messages beyond the lifetime of the process. Save
+// adds a message or replaces the one with the same id, Delete and Clear
+// forget a message or everything sent to a room, Rename moves the messages
+// of a room to a new name, and Recent returns up to limit of the latest
+// messages of every room, oldest first, leaving out direct messages and
+// whispers. Page returns, oldest first, up to limit messages of a room
+// sent before the one with the id before, or the latest ones when before
+// is empty, and nothing when that message is unknown. The manager calls
+// the store while holding its lock, so implementations must be safe for
+// concurrent use and return quickly, see asyncStore.
+type MessageStore interface {
+	Save(msg Message) error
+	Delete(id string) error
+	Clear(room string) error
+	Rename(old, name string) error
+	Recent(limit int) ([]Message, error)
+	Page(room, before string, limit int) ([]Message, error)
+	Close() error
+}
+
+// private reports whether a message was meant for its recipients only.
+func private(msg *Message) bool {
+	return msg.Recipient != "" || len(msg.Recipients) > 0 || msg.Type == typeWhisper
+}
+
+// memoryStore keeps messages in memory, in the order they were first saved.
+type memoryStore struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func (store *memoryStore) Save(msg Message) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for i := range store.messages {
+		if store.messages[i].ID == msg.ID {
+			store.messages[i] = msg
+			return nil
+		}
+	}
+	store.messages = append(store.messages, msg)
+	return nil
+}
+
+func (store *memoryStore) Delete(id string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for i := range store.messages {
+		if store.messages[i].ID == id {
+			store.messages = append(store.messages[:i], store.messages[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (store *memoryStore) Clear(room string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	kept := store.messages[:0]
+	for _, msg := range store.messages {
+		if private(&msg) || msg.Room != room {
+			kept = append(kept, msg)
+		}
+	}
+	store.messages = kept
+	return nil
+}
+
+func (store *memoryStore) Rename(old, name string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for i := range store.messages {
+		if !private(&store.messages[i]) && store.messages[i].Room == old {
+			store.messages[i].Room = name
+		}
+	}
+	return nil
+}
+
+func (store *memoryStore) Recent(limit int) ([]Message, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	counts := make(map[string]int)
+	var recent []Message
+	for i := len(store.messages) - 1; i >= 0; i-- {
+		msg := store.messages[i]
+		if private(&msg) || counts[msg.Room] >= limit {
+			continue
+		}
+		counts[msg.Room]++
+		recent = append(recent, msg)
+	}
+	for i, j := 0, len(recent)-1; i < j; i, j = i+1, j-1 {
+		recent[i], recent[j] = recent[j], recent[i]
+	}
+	return recent, nil
+}
+
+func (store *memoryStore) Page(room, before string, limit int) ([]Message, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var history []Message
+	for _, msg := range store.messages {
+		if !private(&msg) && msg.Room == room {
+			history = append(history, msg)
+		}
+	}
+	return pageOf(history, before, limit), nil
+}
+
+func (store *memoryStore) Close() error {
+	return nil
+}
+
+// sqliteStore keeps messages in the messages table of a SQLite database,
+// each as its JSON encoding next to the columns needed to query it.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS messages (
+	seq       INTEGER PRIMARY KEY AUTOINCREMENT,
+	id        TEXT NOT NULL UNIQUE,
+	room      TEXT NOT NULL,
+	private   INTEGER NOT NULL,
+	timestamp INTEGER NOT NULL,
+	data      TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS messages_room ON messages (room, seq);
+`
+
+// openSQLiteStore opens the database at path, creating it and the
+// messages table if needed.
+func openSQLiteStore(path string) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer, so one connection avoids lock errors.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqliteStore{db: db}, nil
+}
+
+func (store *sqliteStore) Save(msg Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = store.db.Exec(`INSERT INTO messages (id, room, private, timestamp, data) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET data = excluded.data`, msg.ID, msg.Room, private(&msg), msg.Timestamp, string(data))
+	return err
+}
+
+func (store *sqliteStore) Delete(id string) error {
+	_, err := store.db.Exec(`DELETE FROM messages WHERE id = ?`, id)
+	return err
+}
+
+func (store *sqliteStore) Clear(room string) error {
+	_, err := store.db.Exec(`DELETE FROM messages WHERE room = ? AND NOT private`, room)
+	return err
+}
+
+func (store *sqliteStore) Rename(old, name string) error {
+	_, err := store.db.Exec(`UPDATE messages SET room = ?, data = json_set(data, '$.room', ?) WHERE room = ? AND NOT private`, name, name, old)
+	return err
+}
+
+func (store *sqliteStore) Recent(limit int) ([]Message, error) {
+	rows, err := store.db.Query(`SELECT data FROM (
+		SELECT data, seq, ROW_NUMBER() OVER (PARTITION BY room ORDER BY seq DESC) AS n
+		FROM messages WHERE NOT private
+	) WHERE n <= ? ORDER BY seq`, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanMessages(rows)
+}
+
+func (store *sqliteStore) Page(room, before string, limit int) ([]Message, error) {
+	query := `SELECT data FROM (
+		SELECT data, seq FROM messages WHERE room = ? AND NOT private ORDER BY seq DESC LIMIT ?
+	) ORDER BY seq`
+	args := []interface{}{room, limit}
+	if before != "" {
+		query = `SELECT data FROM (
+			SELECT data, seq FROM messages WHERE room = ? AND NOT private
+			AND seq < (SELECT seq FROM messages WHERE id = ? AND room = ?) ORDER BY seq DESC LIMIT ?
+		) ORDER BY seq`
+		args = []interface{}{room, before, room, limit}
+	}
+	rows, err := store.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanMessages(rows)
+}
+
+// scanMessages decodes the messages in the data column of rows and closes them.
+func scanMessages(rows *sql.Rows) ([]Message, error) {
+	defer rows.Close()
+
+	var messages []Message
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var msg Message
+		if err := json.Unmarshal([]byte(data), &msg); err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
+
+func (store *sqliteStore) Close() error {
+	return store.db.Close()
+}
+
+// asyncStore keeps writes to a slow store such as sqliteStore off the hot
+// path. Writes are queued and applied in order by a single goroutine, and
+// dropped with errStoreBusy while storeQueueSize of them are waiting.
+// Failed writes are only logged. Recent and Page read straight from the store.
+type asyncStore struct {
+	store  MessageStore
+	logger *slog.Logger
+	writes chan func() error
+	done   chan struct{}
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// newAsyncStore starts applying queued writes to store.
+func newAsyncStore(store MessageStore, logger *slog.Logger) *asyncStore {
+	async := &asyncStore{store: store, logger: logger, writes: make(chan func() error, storeQueueSize), done: make(chan struct{})}
+	go async.run()
+	return async
+}
+
+func (async *asyncStore) run() {
+	defer close(async.done)
+	for write := range async.writes {
+		if err := write(); err != nil {
+			async.logger.Error("persisting messages failed", "err", err)
+		}
+	}
+}
+
+// enqueue queues a write unless the queue is full or the store closed.
+func (async *asyncStore) enqueue(write func() error) error {
+	async.mu.Lock()
+	defer async.mu.Unlock()
+
+	if async.closed {
+		return errors.New("message store is closed")
+	}
+	select {
+	case async.writes <- write:
+		return nil
+	default:
+		return errStoreBusy
+	}
+}
+
+func (async *asyncStore) Save(msg Message) error {
+	return async.enqueue(func() error { return async.store.Save(msg) })
+}
+
+func (async *asyncStore) Delete(id string) error {
+	return async.enqueue(func() error { return async.store.Delete(id) })
+}
+
+func (async *asyncStore) Clear(room string) error {
+	return async.enqueue(func() error { return async.store.Clear(room) })
+}
+
+func (async *asyncStore) Rename(old, name string) error {
+	return async.enqueue(func() error { return async.store.Rename(old, name) })
+}
+
+func (async *asyncStore) Recent(limit int) ([]Message, error) {
+	return async.store.Recent(limit)
+}
+
+func (async *asyncStore) Page(room, before string, limit int) ([]Message, error) {
+	return async.store.Page(room, before, limit)
+}
+
+// Close applies the writes still queued and closes the store.
+func (async *asyncStore) Close() error {
+	async.mu.Lock()
+	if !async.closed {
+		async.closed = true
+		close(async.writes)
+	}
+	async.mu.Unlock()
+
+	<-async.done
+	return async.store.Close()
+}
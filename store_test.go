@@ -0,0 +1,126 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// stores returns a fresh instance of every MessageStore implementation.
+func stores(t *testing.T) map[string]MessageStore {
+	t.Helper()
+	db, err := openSQLiteStore(filepath.Join(t.TempDir(), "chat.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return map[string]MessageStore{"memory": &memoryStore{}, "sqlite": db}
+}
+
+// ids returns the ids of messages in order.
+func ids(messages []Message) []string {
+	ids := make([]string, len(messages))
+	for i := range messages {
+		ids[i] = messages[i].ID
+	}
+	return ids
+}
+
+// save stores messages, failing the test if one cannot be saved.
+func save(t *testing.T, store MessageStore, messages ...Message) {
+	t.Helper()
+	for _, msg := range messages {
+		if err := store.Save(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestStorePage(t *testing.T) {
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			save(t, store,
+				Message{ID: "1", Room: "lobby", Content: "one"},
+				Message{ID: "2", Room: "lobby", Content: "two"},
+				Message{ID: "dm", Room: "lobby", Recipient: "bob", Content: "psst"},
+				Message{ID: "3", Room: "lobby", Content: "three"},
+				Message{ID: "4", Room: "other", Content: "four"},
+				Message{ID: "5", Room: "lobby", Content: "five"},
+			)
+			for _, tc := range []struct {
+				before string
+				limit  int
+				want   []string
+			}{
+				{"", 10, []string{"1", "2", "3", "5"}},
+				{"", 2, []string{"3", "5"}},
+				{"5", 2, []string{"2", "3"}},
+				{"2", 10, []string{"1"}},
+				{"1", 10, nil},
+				{"4", 10, nil},
+				{"unknown", 10, nil},
+			} {
+				page, err := store.Page("lobby", tc.before, tc.limit)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := ids(page); !slices.Equal(got, tc.want) {
+					t.Errorf("Page(lobby, %q, %d) = %v, want %v", tc.before, tc.limit, got, tc.want)
+				}
+			}
+		})
+	}
+}
+
+func TestStoreRename(t *testing.T) {
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			save(t, store,
+				Message{ID: "1", Room: "old", Content: "one"},
+				Message{ID: "dm", Room: "old", Recipient: "bob", Content: "psst"},
+				Message{ID: "2", Room: "other", Content: "two"},
+			)
+			if err := store.Rename("old", "new"); err != nil {
+				t.Fatal(err)
+			}
+			page, err := store.Page("new", "", 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(page) != 1 || page[0].ID != "1" || page[0].Room != "new" {
+				t.Errorf("Page(new) = %+v, want message 1 in room new", page)
+			}
+			if page, _ := store.Page("old", "", 10); len(page) != 0 {
+				t.Errorf("Page(old) = %+v after renaming it", page)
+			}
+			if page, _ := store.Page("other", "", 10); len(page) != 1 {
+				t.Errorf("Page(other) = %+v, want it untouched", page)
+			}
+		})
+	}
+}
+
+func TestStoreClear(t *testing.T) {
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			save(t, store,
+				Message{ID: "1", Room: "lobby", Content: "one"},
+				Message{ID: "dm", Room: "lobby", Recipient: "bob", Content: "psst"},
+				Message{ID: "2", Room: "other", Content: "two"},
+			)
+			if err := store.Clear("lobby"); err != nil {
+				t.Fatal(err)
+			}
+			if page, _ := store.Page("lobby", "", 10); len(page) != 0 {
+				t.Errorf("Page(lobby) = %+v after clearing it", page)
+			}
+			recent, err := store.Recent(10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := ids(recent); !slices.Equal(got, []string{"2"}) {
+				t.Errorf("Recent = %v after clearing lobby, want [2]", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// connectionThrottle limits how many connections a single IP may open
+// per window, counting them in fixed windows that start with the first
+// connection of an IP. Counts of windows that are over are swept once a
+// window, so IPs that stop connecting are forgotten.
+type connectionThrottle struct {
+	limit  int
+	window time.Duration
+
+	mu      sync.Mutex
+	counts  map[string]*connectionCount
+	sweptAt time.Time
+}
+
+// connectionCount is how many connections an IP opened since start.
+type connectionCount struct {
+	start time.Time
+	n     int
+}
+
+// newConnectionThrottle allows limit connections per IP every window.
+func newConnectionThrottle(limit int, window time.Duration) *connectionThrottle {
+	return &connectionThrottle{limit: limit, window: window, counts: make(map[string]*connectionCount), sweptAt: time.Now()}
+}
+
+// allow counts a connection from ip and reports whether it is within the
+// limit, and if not, how long until its window is over. Rejected
+// connections count as well, so retrying in a tight loop does not help.
+func (t *connectionThrottle) allow(ip string) (bool, time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(t.sweptAt) >= t.window {
+		for key, count := range t.counts {
+			if now.Sub(count.start) >= t.window {
+				delete(t.counts, key)
+			}
+		}
+		t.sweptAt = now
+	}
+
+	count, ok := t.counts[ip]
+	if !ok || now.Sub(count.start) >= t.window {
+		count = &connectionCount{start: now}
+		t.counts[ip] = count
+	}
+	count.n++
+	if count.n > t.limit {
+		return false, count.start.Add(t.window).Sub(now)
+	}
+	return true, 0
+}
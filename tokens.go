@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// reconnectTTL is how long after disconnecting a client may resume its identity.
+const reconnectTTL = 2 * time.Minute
+
+// tokenTTL is how long a reconnect token is valid after it was issued on
+// connect, so one that leaked cannot be used for good.
+const tokenTTL = 24 * time.Hour
+
+// session is the identity a disconnected client may resume with its
+// token. Only the token issued on the connection that ended, which
+// carries its nonce, resumes it.
+type session struct {
+	name    string
+	room    string
+	rooms   []string
+	nonce   string
+	expires time.Time
+}
+
+// randomSecret returns the secret reconnect tokens are signed with unless
+// one is configured, so tokens do not outlive the process, just like the
+// sessions they resume.
+func randomSecret() []byte {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return secret
+}
+
+// newNonce returns a random nonce to tell the tokens of different
+// connections apart.
+func newNonce() string {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(nonce)
+}
+
+// issueToken returns a reconnect token for the client id, valid for
+// tokenTTL. It reads "<id>.<expiry>.<nonce>.<signature>", with the id and
+// the HMAC-SHA256 signature of everything before it base64 encoded and
+// the expiry in Unix seconds.
+func (manager *ClientManager) issueToken(id, nonce string) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(id)) + "." + strconv.FormatInt(time.Now().Add(tokenTTL).Unix(), 10) + "." + nonce
+	return payload + "." + base64.RawURLEncoding.EncodeToString(manager.sign(payload))
+}
+
+// verifyToken checks the signature and expiry of a reconnect token and
+// returns the client id and nonce it was issued with.
+func (manager *ClientManager) verifyToken(token string) (string, string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 4 {
+		return "", "", errors.New("malformed token")
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(parts[3])
+	if err != nil {
+		return "", "", errors.New("malformed token")
+	}
+	if !hmac.Equal(mac, manager.sign(strings.Join(parts[:3], "."))) {
+		return "", "", errors.New("invalid token signature")
+	}
+	id, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", "", errors.New("malformed token")
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", "", errors.New("malformed token")
+	}
+	if time.Now().After(time.Unix(expires, 0)) {
+		return "", "", errors.New("token expired")
+	}
+	return string(id), parts[2], nil
+}
+
+func (manager *ClientManager) sign(payload string) []byte {
+	mac := hmac.New(sha256.New, manager.tokenSecret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// remember keeps the identity of a disconnected client around for
+// reconnectTTL, forgetting sessions that have expired in the meantime.
+// The caller must hold manager.mu.
+func (manager *ClientManager) remember(conn *Client) {
+	now := time.Now()
+	for id, session := range manager.sessions {
+		if now.After(session.expires) {
+			delete(manager.sessions, id)
+		}
+	}
+	manager.sessions[conn.id] = session{name: conn.name, room: conn.room, rooms: conn.subscriptions(), nonce: conn.nonce, expires: now.Add(reconnectTTL)}
+}
+
+// revoke drops a room from the sessions it was remembered in, so nobody
+// resumes into a protected room after it has been closed. Whoever opens
+// it again may protect it with another password. The caller must hold
+// manager.mu.
+func (manager *ClientManager) revoke(room string) {
+	for id, session := range manager.sessions {
+		rooms := slices.DeleteFunc(session.rooms, func(r string) bool { return r == room })
+		if len(rooms) == len(session.rooms) {
+			continue
+		}
+		session.rooms = rooms
+		if session.room == room {
+			session.room = ""
+		}
+		manager.sessions[id] = session
+	}
+}
+
+// resume restores the client identity a reconnect token was issued for.
+// It fails for invalid or expired tokens, tokens issued on another
+// connection than the one that ended, expired sessions, ids still in use
+// and, for authenticated clients, sessions of another user.
+func (manager *ClientManager) resume(conn *Client, token string) error {
+	id, nonce, err := manager.verifyToken(token)
+	if err != nil {
+		return err
+	}
+	if conn.authenticated && id != conn.id {
+		return errors.New("token belongs to another user")
+	}
+
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	session, ok := manager.sessions[id]
+	if !ok || time.Now().After(session.expires) {
+		return errors.New("session expired")
+	}
+	if session.nonce != nonce {
+		return errors.New("token of another session")
+	}
+	if len(manager.connectionsFor(id)) > 0 {
+		return errors.New("client is still connected")
+	}
+	delete(manager.sessions, id)
+	conn.id, conn.name = id, session.name
+	// Clients whose rooms were all revoked start over in the default room.
+	if len(session.rooms) > 0 {
+		conn.room = session.room
+		conn.rooms = make(map[string]bool, len(session.rooms))
+		for _, room := range session.rooms {
+			conn.rooms[room] = true
+		}
+	}
+	conn.resumed = true
+	return nil
+}
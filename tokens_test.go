@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/base64"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestVerifyToken(t *testing.T) {
+	manager := NewClientManager()
+	id, nonce, err := manager.verifyToken(manager.issueToken("alice", "n1"))
+	if err != nil || id != "alice" || nonce != "n1" {
+		t.Fatalf("verifyToken = %q, %q, %v, want alice, n1", id, nonce, err)
+	}
+
+	expired := base64.RawURLEncoding.EncodeToString([]byte("alice")) + "." + strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10) + ".n1"
+	expired += "." + base64.RawURLEncoding.EncodeToString(manager.sign(expired))
+	if _, _, err := manager.verifyToken(expired); err == nil {
+		t.Error("verifyToken accepted an expired token")
+	}
+	if _, _, err := NewClientManager().verifyToken(manager.issueToken("alice", "n1")); err == nil {
+		t.Error("verifyToken accepted a token signed with another secret")
+	}
+	if _, _, err := manager.verifyToken("alice"); err == nil {
+		t.Error("verifyToken accepted a malformed token")
+	}
+}
+
+func TestOnlyTheLatestTokenResumes(t *testing.T) {
+	server := newTestServer(t, nil)
+	first := server.dial(t, "")
+	first.conn.Close()
+	eventually(t, "remembering the session", server.manager.idleForTest)
+
+	second := server.dial(t, "token="+first.token)
+	if second.id != first.id {
+		t.Fatalf("resuming gave id %s, want %s", second.id, first.id)
+	}
+	second.conn.Close()
+	eventually(t, "remembering the session", server.manager.idleForTest)
+
+	if third := server.dial(t, "token="+first.token); third.id == first.id {
+		t.Error("the token of an earlier connection resumed the session")
+	}
+}
+
+func TestResumingSkipsClosedProtectedRooms(t *testing.T) {
+	server := newTestServer(t, nil)
+	inSecret := func(id string) bool {
+		conn := server.manager.clientByID(t, id)
+		server.manager.mu.RLock()
+		defer server.manager.mu.RUnlock()
+		return server.manager.rooms["secret"][conn]
+	}
+
+	mallory := server.dial(t, "")
+	mallory.send(Message{Content: "/join secret first"})
+	mallory.waitFor(joined(mallory.id, "secret"))
+	mallory.conn.Close()
+	eventually(t, "closing the room", server.manager.idleForTest)
+
+	carol := server.dial(t, "")
+	carol.send(Message{Content: "/join secret second"})
+	carol.waitFor(joined(carol.id, "secret"))
+	carol.say("the plan")
+	carol.waitFor(chat("the plan"))
+
+	resumed := server.dial(t, "token="+mallory.token)
+	if resumed.id != mallory.id {
+		t.Fatalf("resuming gave id %s, want %s", resumed.id, mallory.id)
+	}
+	for _, m := range resumed.replayed {
+		if chat("the plan")(m) {
+			t.Fatalf("mallory was replayed %+v from carol's room", m)
+		}
+	}
+	if inSecret(mallory.id) {
+		t.Fatal("mallory resumed into carol's room")
+	}
+	carol.say("the other plan")
+	resumed.expectNone(chat("the other plan"), 200*time.Millisecond)
+
+	// Resuming before anyone reopens the room must not reopen it unprotected.
+	server.dial(t, "")
+	resumed.send(Message{Content: "/join secret second"})
+	resumed.waitFor(joined(mallory.id, "secret"))
+	resumed.conn.Close()
+	carol.conn.Close()
+	eventually(t, "closing the room", func() bool {
+		server.manager.mu.RLock()
+		defer server.manager.mu.RUnlock()
+		return server.manager.rooms["secret"] == nil
+	})
+	again := server.dial(t, "token="+resumed.token)
+	if again.id != mallory.id {
+		t.Fatalf("resuming gave id %s, want %s", again.id, mallory.id)
+	}
+	if inSecret(mallory.id) {
+		t.Error("mallory reopened the closed room by resuming")
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// maxAttachments is how many attachments a single message may reference.
+const maxAttachments = 10
+
+// defaultMaxUploadSize is the largest file uploadPage accepts by default.
+const defaultMaxUploadSize = 10 << 20
+
+// uploadPage stores the file sent as the "file" field of a multipart form
+// in the manager's upload directory and responds with the id messages use to reference it.
+// Clients are authenticated the same way as for the websocket.
+func (manager *ClientManager) uploadPage(res http.ResponseWriter, req *http.Request) {
+	if !allowMethods(res, req, http.MethodPost) {
+		return
+	}
+	if manager.uploadDir == "" {
+		http.Error(res, "uploads are disabled", http.StatusNotFound)
+		return
+	}
+	if _, err := manager.authenticate(req); err != nil {
+		http.Error(res, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// The form around the file takes a little room of its own.
+	req.Body = http.MaxBytesReader(res, req.Body, manager.maxUploadSize+maxRequestBody)
+	file, header, err := req.FormFile("file")
+	if err == nil && header.Size > manager.maxUploadSize {
+		file.Close()
+		err = errors.New("file too large")
+	}
+	if err != nil {
+		http.Error(res, "expected a multipart form with a file of at most "+strconv.FormatInt(manager.maxUploadSize, 10)+" bytes", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	id := uuid.NewV4().String()
+	out, err := os.OpenFile(filepath.Join(manager.uploadDir, id), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		manager.logger.Error("storing upload failed", "err", err)
+		http.Error(res, "storing the file failed", http.StatusInternalServerError)
+		return
+	}
+	_, err = io.Copy(out, file)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		manager.logger.Error("storing upload failed", "err", err)
+		http.Error(res, "storing the file failed", http.StatusInternalServerError)
+		return
+	}
+	manager.logger.Info("file uploaded", "id", id, "remote", manager.remoteAddr(req))
+	manager.writeJSON(res, http.StatusCreated, map[string]string{"id": id})
+}
+
+// validAttachment reports whether an attachment reference is either the
+// id of an upload or a plain http or https URL without credentials.
+func validAttachment(ref string) bool {
+	if id, err := uuid.FromString(ref); err == nil && id.String() == ref {
+		return true
+	}
+	u, err := url.Parse(ref)
+	if err != nil {
+		return false
+	}
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" && u.User == nil
+}
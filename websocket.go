@@ -1,9 +1,118 @@
 package main
 
 import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/gorilla/websocket"
+	uuid "github.com/satori/go.uuid"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// defaultRoom is the room every client lands in until it joins another one.
+	defaultRoom = "lobby"
+
+	// statusOnline is the presence status of clients that did not pick another one.
+	statusOnline = "online"
+
+	// writeWait is how long a single write to a client may take.
+	writeWait = 10 * time.Second
+
+	// pongWait is how long we wait for a pong before considering the client gone.
+	pongWait = 60 * time.Second
+
+	// pingPeriod is how often clients are pinged. It must be less than pongWait.
+	pingPeriod = (pongWait * 9) / 10
+
+	// defaultHistorySize is how many broadcast messages are kept for replay.
+	defaultHistorySize = 50
+
+	// defaultMessageRate and defaultMessageBurst configure how many
+	// messages per second, and in a single burst, a client may send.
+	defaultMessageRate  = 5
+	defaultMessageBurst = 10
+
+	// maxNameLength is the longest nickname a client may choose.
+	maxNameLength = 32
+
+	// maxContentLength is the longest message content, in characters, a client may send.
+	maxContentLength = 1000
+
+	// defaultHistoryPage and maxHistoryPage are how many messages a history
+	// request returns when it does not say and at most.
+	defaultHistoryPage = 50
+	maxHistoryPage     = 100
+
+	// maxTTL is the longest a disappearing message may live.
+	maxTTL = 24 * time.Hour
+
+	// maxRecipients is how many recipients a single direct message may have.
+	maxRecipients = 20
+
+	// maxReactionLength is the longest reaction, in bytes, and maxReactions
+	// how many different reactions a single message may collect.
+	maxReactionLength = 32
+	maxReactions      = 20
+
+	// maxClientMsgIDLength is the longest idempotency key a client may send,
+	// and dedupWindow how long it is remembered.
+	maxClientMsgIDLength = 64
+	dedupWindow          = 2 * time.Minute
+
+	// maxMessageSize is the largest message, in bytes, a client may send.
+	// Larger frames make the read fail and the client is unregistered.
+	maxMessageSize = 4096
+
+	// sendBufferSize is how many outgoing messages may queue up for a
+	// client before it is considered too slow and dropped.
+	sendBufferSize = 256
+
+	// defaultSlowThreshold is how many sends in a row may fail before a
+	// client is dropped, and slowWindow the period they must fail within.
+	defaultSlowThreshold = 3
+	slowWindow           = 10 * time.Second
+
+	// Overflow policies decide what push does once a client's send buffer
+	// is full: overflowDisconnect drops the new frame and removes clients
+	// that stay too slow, overflowDropNewest only drops the new frame and
+	// overflowDropOldest drops the oldest queued frame to make room for it.
+	overflowDisconnect = "disconnect"
+	overflowDropNewest = "drop-newest"
+	overflowDropOldest = "drop-oldest"
+
+	// retryAfter is the delay suggested to clients turned away while the
+	// server is full or shutting down.
+	retryAfter = 30 * time.Second
+
+	// defaultQueueSize is how many messages may wait for the manager.
+	defaultQueueSize = 256
+
+	// queueWait is how long a reader waits for room in a full broadcast queue.
+	queueWait = time.Second
+
+	// closeWait is how long we wait for a close frame to be written.
+	closeWait = time.Second
 )
 
 // ClientManager will keep track of all the
@@ -11,125 +120,2314 @@ import (
 // to become registered, clients that have become
 // destroyed and are waiting to be removed,
 // and messages that are to be broadcasted to and from all connected clients.
+// Clients are additionally grouped by the room they are in and by their
+// id, since a user may be connected more than once, e.g. from two tabs.
+// The most recent broadcast messages of every room are kept in history and
+// replayed to clients as they enter the room, and sessions of recently disconnected
+// clients are kept so they may resume.
+// Rooms may be protected by a password, which only lives as long as the
+// room, and so does the history of protected rooms.
+// Messages sent with a TTL are deleted again once it has passed.
+// While draining no new clients are accepted.
+// The mutex guards clients, rooms, users, passwords, expiries, history, sessions, mutes, stopped and the rooms of every client.
 type ClientManager struct {
-	clients    map[*Client]bool
-	broadcast  chan []byte
+	mu        sync.RWMutex
+	writers   sync.WaitGroup
+	draining  atomic.Bool
+	stopped   bool
+	clients   map[*Client]bool
+	rooms     map[string]map[*Client]bool
+	users     map[string][]*Client
+	passwords map[string]roomPassword
+	expiries  map[string]expiry
+	history   map[string][]Message
+	sessions  map[string]session
+	mutes     map[string]time.Time
+	dedup     *idempotencyKeys
+
+	// interceptors see every message clients send, see Use, and commands
+	// are the slash commands they may run, see Handle.
+	interceptors []Interceptor
+	commands     map[string]command
+
+	// Settings, which must not change once the manager has started.
+
+	// historySize is how many messages are kept in history per room.
+	historySize int
+	// messageRate and messageBurst configure the rate limiter of new clients.
+	messageRate  float64
+	messageBurst int
+	// slowThreshold is how many failed sends in a row make a client too slow.
+	slowThreshold int
+	// overflowPolicy is what happens once a client's send buffer is full.
+	overflowPolicy string
+	// adminToken makes the clients presenting it on connect admins.
+	adminToken string
+	// maxClients is how many clients may be connected at once, if positive.
+	maxClients int
+	// idleTimeout drops clients sending no message or ping for that long,
+	// if positive. Pongs do not count, since they answer our pings.
+	idleTimeout time.Duration
+	// presenceInterval is how often every room is sent its occupants, if
+	// positive.
+	presenceInterval time.Duration
+	// hideSpectators leaves spectators out of presence.
+	hideSpectators bool
+	// includeSender sends senders their own messages back by default.
+	includeSender bool
+	// deadLetters, if set, learns about messages that were not delivered.
+	deadLetters DeadLetterSink
+	// throttle, if set, limits how often an IP may connect.
+	throttle *connectionThrottle
+	// trustedProxies may tell the IP of clients behind them.
+	trustedProxies []netip.Prefix
+	// store, if set, keeps messages across restarts.
+	store  MessageStore
+	logger *slog.Logger
+
+	// upgrader upgrades websocket requests.
+	upgrader websocket.Upgrader
+	// requireSubprotocol turns away requests without one of our subprotocols.
+	requireSubprotocol bool
+	// compressionLevel and compressionThreshold tune compression if it is
+	// negotiated, which only messages of at least the threshold use.
+	compressionLevel     int
+	compressionThreshold int
+	// authenticate decides who may connect or upload.
+	authenticate func(*http.Request) (string, error)
+	// uploadDir is where uploads go, up to maxUploadSize bytes each.
+	uploadDir     string
+	maxUploadSize int64
+	// broadcastSecret signs admin requests, see verifyAdminRequest.
+	broadcastSecret string
+	// tokenSecret signs reconnect tokens.
+	tokenSecret []byte
+
+	// allowedOrigins are the origins checkOrigin accepts and nonces those
+	// of recent admin requests, see verifyAdminRequest. Unlike the other
+	// settings the origins may be replaced while the manager runs.
+	allowedOrigins atomic.Pointer[[]string]
+	nonces         usedNonces
+
+	broadcast  chan *Message
 	register   chan *Client
 	unregister chan *Client
+	join       chan *RoomChange
+	stop       chan chan struct{}
+	expire     chan string
+}
+
+// NewClientManager returns a manager with the default settings. Call
+// start in a goroutine before handing it any clients.
+func NewClientManager() *ClientManager {
+	manager := &ClientManager{
+		broadcast:      make(chan *Message, defaultQueueSize),
+		register:       make(chan *Client),
+		unregister:     make(chan *Client),
+		join:           make(chan *RoomChange),
+		stop:           make(chan chan struct{}),
+		expire:         make(chan string),
+		clients:        make(map[*Client]bool),
+		rooms:          make(map[string]map[*Client]bool),
+		users:          make(map[string][]*Client),
+		passwords:      make(map[string]roomPassword),
+		expiries:       make(map[string]expiry),
+		history:        make(map[string][]Message),
+		sessions:       make(map[string]session),
+		mutes:          make(map[string]time.Time),
+		dedup:          newIdempotencyKeys(),
+		historySize:    defaultHistorySize,
+		messageRate:    defaultMessageRate,
+		messageBurst:   defaultMessageBurst,
+		slowThreshold:  defaultSlowThreshold,
+		overflowPolicy: overflowDisconnect,
+		includeSender:  true,
+		interceptors:   append([]Interceptor(nil), defaultInterceptors...),
+		commands:       defaultCommands(),
+		logger:         slog.Default(),
+
+		compressionLevel:     flate.BestSpeed,
+		compressionThreshold: 256,
+		authenticate:         anonymous,
+		maxUploadSize:        defaultMaxUploadSize,
+		tokenSecret:          randomSecret(),
+		nonces:               usedNonces{seen: make(map[string]time.Time)},
+	}
+	// The CheckOrigin lets browsers on the allowed outside domains connect
+	// without cross origin resource sharing (CORS) errors.
+	manager.upgrader = websocket.Upgrader{
+		CheckOrigin:  manager.checkOrigin,
+		Subprotocols: []string{subprotocol, msgpackSubprotocol},
+	}
+	return manager
+}
+
+// restore schedules the expiry of the recent messages kept by the store
+// that have a TTL, dropping the ones that expired while the server was
+// down. The history of a room is only loaded once someone enters it, see
+// reload. Call it before start.
+func (manager *ClientManager) restore() error {
+	messages, err := manager.store.Recent(manager.historySize)
+	if err != nil {
+		return err
+	}
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	for _, message := range messages {
+		if message.TTL > 0 {
+			left := time.Until(time.UnixMilli(message.Timestamp).Add(time.Duration(message.TTL) * time.Second))
+			if left <= 0 {
+				id := message.ID
+				manager.persist(func(store MessageStore) error { return store.Delete(id) })
+				continue
+			}
+			manager.schedule(message.ID, message.Room, left)
+		}
+	}
+	return nil
+}
+
+// reload fills the history of a room that is opened again with the
+// recent messages the store kept while nobody was in it, leaving out
+// those whose TTL has passed. The caller must hold manager.mu.
+func (manager *ClientManager) reload(room string) {
+	if manager.store == nil || manager.historySize <= 0 {
+		return
+	}
+	messages, err := manager.store.Page(room, "", manager.historySize)
+	if err != nil {
+		manager.logger.Warn("loading history failed", "room", room, "err", err)
+		return
+	}
+	now := time.Now()
+	history := messages[:0]
+	for _, message := range messages {
+		if message.TTL > 0 && !now.Before(time.UnixMilli(message.Timestamp).Add(time.Duration(message.TTL)*time.Second)) {
+			continue
+		}
+		history = append(history, message)
+	}
+	if len(history) > 0 {
+		manager.history[room] = history
+	}
 }
 
-// Client has a unique id, a socket connection, and a message waiting to be sent.
+// Client has a unique id, a nickname, a socket connection, the rooms it is in, and a message waiting to be sent.
+// The id is the authenticated user id, or a random one for anonymous clients.
+// The nickname defaults to the id until the client picks one.
+// Messages that do not name one of the rooms go to room, the one the
+// client last joined, which is empty when it left that room.
+// The limiter throttles how fast the client may send messages,
+// and admins may use moderation commands such as /kick.
+// The protocol is the subprotocol negotiated during the handshake, the
+// codec how messages to and from the client are serialized,
+// remoteAddr and userAgent tell where the client connected from, and
+// resumed clients took over their identity with a reconnect token.
+// Clients with echo set receive their own messages back from the server,
+// and readOnly ones are spectators that see everything but may not post.
+// Cancelling the context is the single signal that shuts the client down.
+// Only the write goroutine writes messages to the socket, gorilla/websocket
+// allows no more than one writer at a time: everyone else queues frames
+// on send and asks for a close frame through closeWith. The one exception
+// is the pong the read goroutine answers pings with, written with
+// WriteControl, which gorilla/websocket allows next to any other write.
+// Every client belongs to the manager it was registered with.
 type Client struct {
-	id     string
-	socket *websocket.Conn
-	send   chan []byte
+	manager       *ClientManager
+	ctx           context.Context
+	cancel        context.CancelFunc
+	id            string
+	authenticated bool
+	name          string
+	room          string
+	rooms         map[string]bool
+	status        string
+	admin         bool
+	protocol      string
+	codec         Codec
+	remoteAddr    string
+	userAgent     string
+	resumed       bool
+	echo          bool
+	readOnly      bool
+	socket        *websocket.Conn
+	send          chan frame
+	limiter       *rate.Limiter
+
+	// failures counts the sends in a row that found the buffer full,
+	// starting at firstFailure. Both are guarded by manager.mu.
+	failures     int
+	firstFailure time.Time
+
+	// nonce is carried by the reconnect token issued to the client, so
+	// only that token resumes the session the client leaves behind. It
+	// is guarded by manager.mu.
+	nonce string
+
+	// lastActivity is when the client last sent a message or ping. Only
+	// the read goroutine uses it.
+	lastActivity time.Time
+
+	// stats counts the traffic of the client for clientsPage.
+	stats clientStats
+
+	// quit is set by the read goroutine before unregistering when the
+	// client left with /quit instead of just dropping the connection.
+	quit atomic.Bool
+
+	// closing is the close frame write sends once the context is
+	// cancelled, set by closeWith and closeAfterDrain. Without one write
+	// closes with a generic reason.
+	closing atomic.Pointer[closeFrame]
+}
+
+// clientStats counts what went over a connection. The read and write
+// goroutines update it while clientsPage reads it, hence the atomics.
+// lastActivity mirrors Client.lastActivity, in Unix milliseconds.
+type clientStats struct {
+	messagesReceived atomic.Int64
+	messagesSent     atomic.Int64
+	bytesReceived    atomic.Int64
+	bytesSent        atomic.Int64
+	lastActivity     atomic.Int64
+}
+
+// closeFrame is the close frame that ends a connection. Clients meant to
+// go without losing messages are sent what is still queued first.
+type closeFrame struct {
+	message []byte
+	drain   bool
+}
+
+// clientTypes are the message types clients may send. The others are
+// only ever produced by the server.
+var clientTypes = map[string]bool{
+	"":          true,
+	typeTyping:  true,
+	typeEdit:    true,
+	typeDelete:  true,
+	typeStatus:  true,
+	typeWhisper: true,
+	typeHistory: true,
+	typeReact:   true,
+}
+
+// statuses are the presence statuses a client may choose from.
+var statuses = map[string]bool{
+	statusOnline: true,
+	"away":       true,
+	"busy":       true,
+}
+
+// features are the capabilities announced to clients in the hello message.
+var features = []string{"rooms", "history", "typing", "edit", "delete", "status", "whisper", "replies", "mentions", "binary", "batching", "subscriptions", "msgpack", "idempotency", "reactions"}
+
+// referenceTypes are the client message types whose id refers to an
+// earlier message instead of identifying the message itself.
+var referenceTypes = map[string]bool{
+	typeEdit:   true,
+	typeDelete: true,
+	typeReact:  true,
+}
+
+// frame is a single websocket message queued for a client, keeping the
+// message type so binary data goes out the way it came in.
+type frame struct {
+	messageType int
+	data        []byte
+}
+
+// frame encodes a message the way the client wants it, in a text frame
+// for JSON and a binary one for MessagePack.
+func (conn *Client) frame(message *envelope) frame {
+	data, err := message.encode(conn.codec)
+	if err != nil {
+		conn.manager.logger.Error("encoding message failed", "message", message.message.ID, "codec", conn.codec.Name(), "err", err)
+	}
+	return frame{messageType: conn.codec.FrameType(), data: data}
 }
 
+// Message types. A message without a type is a regular chat message.
+const (
+	typeTyping   = "typing"
+	typeToken    = "token"
+	typeError    = "error"
+	typeSystem   = "system"
+	typeAction   = "action"
+	typeEdit     = "edit"
+	typeDelete   = "delete"
+	typeStatus   = "status"
+	typeJoin     = "join"
+	typeLeave    = "leave"
+	typeAck      = "ack"
+	typeNack     = "nack"
+	typeWhisper  = "whisper"
+	typeHello    = "hello"
+	typeRetry    = "retry"
+	typePresence = "presence"
+	typeClear    = "clear"
+	typeHistory  = "history"
+	typeRename   = "rename"
+	typeReact    = "react"
+	typeReaction = "reaction"
+)
+
+// Error codes carried by error and nack messages, so clients can react
+// to a failure without parsing its human readable content.
+const (
+	codeRateLimited      = "rate_limited"
+	codeBadMessage       = "bad_message"
+	codeBadCommand       = "bad_command"
+	codeForbidden        = "forbidden"
+	codeNotFound         = "not_found"
+	codeUnknownRecipient = "unknown_recipient"
+	codeRecipientBusy    = "recipient_busy"
+	codeServerBusy       = "server_busy"
+)
+
+// errSlowClient is returned when a client's send buffer is full.
+var errSlowClient = errors.New("not keeping up")
+
+// Message is the wire format exchanged with the clients. Type tells
+// regular chat messages, which have none, apart from other events such as
+// typing.
 type Message struct {
-	Sender    string `json:"sender,omitempty"`
-	Recipient string `json:"recipient,omitempty"`
+	// ID and Timestamp are set by the server, the latter in Unix
+	// milliseconds, so clients can deduplicate messages and rely on a
+	// single clock for ordering. Edit, delete and react messages name the
+	// message they refer to by its ID.
+	ID   string `json:"id,omitempty"`
+	Type string `json:"type,omitempty"`
+	// Sender holds the id of the sending client and Name its nickname.
+	Sender string `json:"sender,omitempty"`
+	Name   string `json:"name,omitempty"`
+	// Recipient turns a message into a direct one delivered to a single
+	// client, and Recipients into one delivered to each of several. The
+	// hello carries the id assigned to the client as Recipient and its
+	// nickname as Name.
+	Recipient  string   `json:"recipient,omitempty"`
+	Recipients []string `json:"recipients,omitempty"`
+	// Room is the room a message belongs to. Clients may set it to send to
+	// any of their rooms, and otherwise send to the room they last joined.
+	Room      string `json:"room,omitempty"`
 	Content   string `json:"content,omitempty"`
+	Timestamp int64  `json:"timestamp,omitempty"`
+	// Token is the reconnect token handed out to a client on connect.
+	Token string `json:"token,omitempty"`
+	// Status is the presence status of the client an event is about.
+	Status string `json:"status,omitempty"`
+	// Code is one of the error codes of error and nack messages.
+	Code string `json:"code,omitempty"`
+	// ReplyTo names the message in history a message replies to, so
+	// clients can show threads.
+	ReplyTo string `json:"reply_to,omitempty"`
+	// Version and Features are the protocol version and the features the
+	// server supports, sent in the hello.
+	Version  string   `json:"version,omitempty"`
+	Features []string `json:"features,omitempty"`
+	// RetryAfter is how many seconds retry messages ask clients to wait
+	// before reconnecting.
+	RetryAfter int `json:"retry_after,omitempty"`
+	// Attachments reference files by upload id or URL.
+	Attachments []string `json:"attachments,omitempty"`
+	// TTL is how many seconds a room message is kept before it is deleted.
+	TTL int `json:"ttl,omitempty"`
+	// Clients lists the occupants of a room in join and presence events.
+	Clients []ClientInfo `json:"clients,omitempty"`
+	// Rooms counts the occupants of every room in the room list.
+	Rooms map[string]int `json:"rooms,omitempty"`
+	// Mentions are the ids of the clients mentioned in Content.
+	Mentions []string `json:"mentions,omitempty"`
+	// ClientMsgID is picked by the sender, which is acked with it and the
+	// ID, and a message carrying one is delivered only once however often
+	// it is sent again.
+	ClientMsgID string `json:"client_msg_id,omitempty"`
+	// Reactions lists the ids of the clients that reacted to a message, by
+	// reaction, and is sent along with reaction events, which are Removed
+	// when one is taken back.
+	Reactions map[string][]string `json:"reactions,omitempty"`
+	Removed   bool                `json:"removed,omitempty"`
+	// OldRoom is what a room was called before a rename event.
+	OldRoom string `json:"old_room,omitempty"`
+	// Before and Limit ask for up to Limit messages of a room sent before
+	// the one with the id Before, or the latest ones without it, which
+	// are answered with the page of History, oldest first.
+	Before  string    `json:"before,omitempty"`
+	Limit   int       `json:"limit,omitempty"`
+	History []Message `json:"history,omitempty"`
+
+	// Binary holds the payload of a binary frame, which is relayed to the
+	// sender's room untouched instead of being encoded as JSON.
+	Binary []byte `json:"-"`
+
+	// client is the connection a message was read from, which tells
+	// apart the connections of a user connected more than once.
+	client *Client
+}
+
+// encode stamps the message with an id and the current time, unless it
+// already carries them, and wraps it for delivery. The message must not
+// change anymore, since it is only encoded once a client needs it.
+func (manager *ClientManager) encode(message *Message) *envelope {
+	if message.ID == "" {
+		message.ID = uuid.NewV4().String()
+	}
+	if message.Timestamp == 0 {
+		message.Timestamp = now()
+	}
+	return &envelope{message: message}
+}
+
+// presence encodes a join, leave or status event for the client in the
+// given room. Join events also list everyone in the room with their
+// status, so the joining client learns who is around.
+func (manager *ClientManager) presence(kind string, conn *Client, room, content string) *envelope {
+	message := &Message{Type: kind, Sender: conn.id, Name: conn.name, Room: room, Status: conn.status, Content: content}
+	if kind == typeJoin {
+		message.Clients = manager.roster(room)
+	}
+	return manager.encode(message)
+}
+
+// now returns the current time in Unix milliseconds.
+func now() int64 {
+	return time.Now().UnixMilli()
+}
+
+// ClientInfo describes a connected client in listings such as /who.
+// The connection details are only filled in for admins.
+type ClientInfo struct {
+	ID         string `json:"id"`
+	Name       string `json:"name,omitempty"`
+	Status     string `json:"status,omitempty"`
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	UserAgent  string `json:"user_agent,omitempty"`
+	Spectator  bool   `json:"spectator,omitempty"`
 }
 
-var manager = ClientManager{
-	broadcast:  make(chan []byte),
-	register:   make(chan *Client),
-	unregister: make(chan *Client),
-	clients:    make(map[*Client]bool),
+// info describes the client for listings. The caller must hold manager.mu.
+func (conn *Client) info() ClientInfo {
+	return ClientInfo{ID: conn.id, Name: conn.name, Status: conn.status, Spectator: conn.readOnly}
 }
 
+// RoomChange asks the manager to move a client into another room, or to
+// add or remove one of the rooms the client is subscribed to. The
+// password is needed for protected rooms, and protects a room that does
+// not exist yet.
+type RoomChange struct {
+	client   *Client
+	room     string
+	password string
+	mode     int
+}
+
+// Modes of a RoomChange. Joining leaves the current room, subscribing
+// keeps the client in every room it is in.
+const (
+	roomJoin = iota
+	roomSubscribe
+	roomUnsubscribe
+)
+
 // Every time the manager.register channel has data,
 // the client will be added to the map of available clients
-// managed by the client manager. After adding the client,
-// a JSON message is sent to all other clients,
-// not including the one that just connected.
+// managed by the client manager and placed in the default room.
+// The new client first receives a hello describing the protocol, then
+// the recent history of the room, oldest first,
+// and a token it can use to resume its identity after reconnecting.
+// After that a join event carrying the client id and nickname is sent
+// to everyone in that room, welcoming the one that just connected.
+// Resumed clients rejoin their room without an announcement.
 
 // If a client disconnects for any reason,
 // the manager.unregister channel will have data.
 // The channel data in the disconnected client will
 // be closed and the client will be removed from the
-// client manager. A message announcing the
-// disappearance of a socket will be sent to all remaining connections.
+// client manager. A leave event announcing the
+// disappearance of the client will be sent to all remaining connections
+// in the room the client was in.
+
+// If the manager.join channel has data the client
+// leaves its current room and enters the requested one,
+// with both rooms receiving a leave and join event respectively.
+// Subscribing enters a room without leaving any, and unsubscribing
+// leaves a room without entering another.
+
+// If the manager.stop channel has data the server is
+// going down. Every client gets a close frame and is removed,
+// after which the waiting shutdown call is released.
 
 // If the manager.broadcast channel has data
 // it means that we’re trying to send and receive
 // messages. We want to loop through each managed
-// client sending the message to each of them. If
-// for some reason the channel is clogged or the
-// message can’t be sent, we assume the client
-// has disconnected and we remove them instead.
+// client in the message's room sending the message
+// to each of them. If for some reason the channel
+// is clogged or the message can’t be sent, we assume
+// the client has disconnected and we remove them instead.
+// Messages with a recipient skip the broadcast and
+// are delivered to that client only, with a copy
+// echoed back to the sender. Either way the sender
+// receives the server's copy, with its id and
+// timestamp, if includeSender is set, which it is
+// by default. Clients may choose otherwise for
+// themselves with ?echo=false or ?echo=true.
+//
+// Every recipient sees the messages of a connection in the order they were
+// sent, which nothing on the way is allowed to change: the read goroutine
+// submits messages one after another, this single goroutine handles them
+// in the order they were queued, each recipient's send channel is FIFO and
+// its write goroutine, batches included, writes frames in queue order.
+// Dropped messages leave gaps but never reorder the rest. Connections are
+// independent, so messages sent over different connections, even by the
+// same user, may interleave either way.
 func (manager *ClientManager) start() {
+	var snapshots <-chan time.Time
+	if manager.presenceInterval > 0 {
+		ticker := time.NewTicker(manager.presenceInterval)
+		defer ticker.Stop()
+		snapshots = ticker.C
+	}
 	for {
 		select {
+		case <-snapshots:
+			manager.onSnapshot()
+		case id := <-manager.expire:
+			manager.onExpire(id)
 		case conn := <-manager.register:
-			manager.clients[conn] = true
-			jsonMessage, _ := json.Marshal(&Message{Content: "/A new socket has connected."})
-			manager.send(jsonMessage, conn)
+			manager.onRegister(conn)
 		case conn := <-manager.unregister:
-			if _, ok := manager.clients[conn]; ok {
-				close(conn.send)
-				delete(manager.clients, conn)
-				jsonMessage, _ := json.Marshal(&Message{Content: "/A socket has disconnected."})
-				manager.send(jsonMessage, conn)
-			}
+			manager.onUnregister(conn)
+		case change := <-manager.join:
+			manager.onJoin(change)
+		case done := <-manager.stop:
+			manager.onStop()
+			close(done)
 		case message := <-manager.broadcast:
-			for conn := range manager.clients {
-				select {
-				case conn.send <- message:
-				default:
-					close(conn.send)
-					delete(manager.clients, conn)
-				}
+			broadcastQueueDepth.Set(float64(len(manager.broadcast)))
+			manager.onBroadcast(message)
+		}
+	}
+}
+
+// All of the handlers below run on the start goroutine and hold the
+// manager lock while touching the clients and rooms maps, so other
+// goroutines may safely read them under manager.mu.RLock.
+
+func (manager *ClientManager) onRegister(conn *Client) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	// A client whose upgrade raced with shutdown is turned away, or it
+	// would be left connected once everyone else has been closed.
+	if manager.stopped {
+		closeWith(conn, websocket.CloseServiceRestart, "server is shutting down")
+		conn.cancel()
+		return
+	}
+	// Another connection of the same user shares its nickname and status,
+	// while a resumed nickname may have been taken while the client was away.
+	conn.status = statusOnline
+	if others := manager.connectionsFor(conn.id); len(others) > 0 {
+		conn.name, conn.status = others[0].name, others[0].status
+	} else {
+		for other := range manager.clients {
+			if strings.EqualFold(other.name, conn.name) {
+				conn.name = conn.id
+			}
+		}
+	}
+	manager.clients[conn] = true
+	manager.users[conn.id] = append(manager.users[conn.id], conn)
+	connectedClients.Inc()
+	if conn.rooms == nil {
+		conn.room, conn.rooms = defaultRoom, map[string]bool{defaultRoom: true}
+	}
+	for room := range conn.rooms {
+		manager.enter(conn, room)
+	}
+	select {
+	case conn.send <- conn.frame(manager.encode(&Message{Type: typeHello, Recipient: conn.id, Name: conn.name, Version: subprotocol, Features: features})):
+	default:
+		messagesDropped.Inc()
+	}
+	for _, room := range conn.subscriptions() {
+		manager.replay(conn, room)
+	}
+	conn.nonce = newNonce()
+	select {
+	case conn.send <- conn.frame(manager.encode(&Message{Type: typeToken, Token: manager.issueToken(conn.id, conn.nonce)})):
+	default:
+		messagesDropped.Inc()
+	}
+	manager.logger.Info("client connected", "client", conn.id, "remote", conn.remoteAddr, "user_agent", conn.userAgent, "protocol", conn.protocol, "room", conn.room, "resumed", conn.resumed, "clients", len(manager.clients))
+	if conn.resumed {
+		return
+	}
+	manager.announceUser(typeJoin, conn, "/"+conn.name+" has connected. Welcome!")
+}
+
+func (manager *ClientManager) onUnregister(conn *Client) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	// The client may already be gone, e.g. dropped as a slow reader or
+	// closed on shutdown, or never have been registered at all, in which
+	// case its context is cancelled all the same so its write goroutine
+	// closes the socket. Clients that quit on purpose said goodbye and
+	// cannot resume, everyone else may come back with their reconnect
+	// token. Users still connected elsewhere have not gone anywhere, they
+	// only left the rooms none of their other connections are in. The
+	// session is remembered before the client leaves its rooms, so the
+	// protected ones it empties drop out of it again.
+	if _, ok := manager.clients[conn]; !ok {
+		conn.cancel()
+		return
+	}
+	elsewhere := len(manager.connectionsFor(conn.id)) > 1
+	if !elsewhere && !conn.quit.Load() {
+		manager.remember(conn)
+	}
+	manager.remove(conn)
+	content := "/" + conn.name + " has disconnected."
+	if conn.quit.Load() {
+		content = "/" + conn.name + " has left. Goodbye!"
+	}
+	switch {
+	case elsewhere:
+		manager.logger.Info("client closed one of its connections", "client", conn.id, "room", conn.room, "clients", len(manager.clients))
+	case conn.quit.Load():
+		manager.logger.Info("client quit", "client", conn.id, "room", conn.room, "clients", len(manager.clients))
+	default:
+		manager.logger.Info("client disconnected", "client", conn.id, "room", conn.room, "clients", len(manager.clients))
+	}
+	manager.announceUser(typeLeave, conn, content)
+}
+
+func (manager *ClientManager) onJoin(change *RoomChange) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	conn, room := change.client, change.room
+	if _, ok := manager.clients[conn]; !ok {
+		return
+	}
+	switch {
+	case change.mode == roomUnsubscribe:
+		if !conn.rooms[room] {
+			manager.push(conn, conn.frame(manager.encode(&Message{Type: typeError, Code: codeNotFound, Content: "/You are not in room " + room + "."})))
+			return
+		}
+		manager.logger.Info("client left room", "client", conn.id, "room", room)
+		manager.part(conn, room)
+		return
+	case change.mode == roomJoin && conn.room == room:
+		return
+	}
+	// Whoever creates a room may protect it, after that the password
+	// has to match. Public rooms ignore passwords.
+	if !conn.rooms[room] {
+		if password, ok := manager.passwords[room]; ok {
+			if subtle.ConstantTimeCompare(password.hash, hashPassword(password.salt, change.password)) != 1 {
+				manager.push(conn, conn.frame(manager.encode(&Message{Type: typeError, Code: codeForbidden, Content: "/Wrong or missing password for room " + room + "."})))
+				return
+			}
+		} else if _, exists := manager.rooms[room]; !exists && change.password != "" {
+			manager.passwords[room] = roomPassword{salt: room, hash: hashPassword(room, change.password)}
+		}
+	}
+	if change.mode == roomJoin {
+		manager.logger.Info("client changed room", "client", conn.id, "from", conn.room, "to", room)
+		if conn.room != "" {
+			manager.part(conn, conn.room)
+		}
+	} else {
+		manager.logger.Info("client subscribed to room", "client", conn.id, "room", room)
+	}
+	if change.mode == roomJoin || conn.room == "" {
+		conn.room = room
+	}
+	if conn.rooms[room] {
+		return
+	}
+	conn.rooms[room] = true
+	manager.enter(conn, room)
+	manager.replay(conn, room)
+	if !manager.hidden(conn) && manager.alone(conn, room) {
+		manager.announce(room, manager.presence(typeJoin, conn, room, "/"+conn.name+" has joined the room."), nil)
+	}
+}
+
+// onSnapshot sends every room the full list of its occupants, so clients
+// that missed a join or leave event still end up with the right list.
+func (manager *ClientManager) onSnapshot() {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	for room := range manager.rooms {
+		manager.announce(room, manager.encode(&Message{Type: typePresence, Room: room, Clients: manager.roster(room)}), nil)
+	}
+}
+
+// onExpire deletes a message whose TTL ran out from history and tells
+// its room, just as if the sender had deleted it.
+func (manager *ClientManager) onExpire(id string) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	expiry, ok := manager.expiries[id]
+	if !ok {
+		return
+	}
+	delete(manager.expiries, id)
+	if room, i := manager.lookup(id); i >= 0 {
+		manager.history[room] = append(manager.history[room][:i], manager.history[room][i+1:]...)
+	}
+	manager.persist(func(store MessageStore) error { return store.Delete(id) })
+	manager.announce(expiry.room, manager.encode(&Message{Type: typeDelete, ID: id, Room: expiry.room}), nil)
+}
+
+func (manager *ClientManager) onStop() {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	manager.stopped = true
+	manager.logger.Info("closing all clients", "clients", len(manager.clients))
+	for conn := range manager.clients {
+		manager.suggestRetry(conn, retryAfter)
+		manager.remove(conn)
+	}
+}
+
+func (manager *ClientManager) onBroadcast(message *Message) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	if message.Type == typeSystem {
+		manager.system(message)
+		return
+	}
+	sender := message.client
+	if _, ok := manager.clients[sender]; !ok {
+		return
+	}
+	message.Name = sender.name
+	if message.Binary != nil {
+		manager.relay(sender, message.Binary)
+		return
+	}
+	if message.Type == typeEdit || message.Type == typeDelete {
+		manager.change(sender, message)
+		return
+	}
+	if message.Type == typeReact {
+		manager.react(sender, message)
+		return
+	}
+	if message.Type == typeStatus {
+		for _, conn := range manager.connectionsFor(sender.id) {
+			conn.status = message.Content
+		}
+		manager.announcePresence(typeStatus, sender, "/"+sender.name+" is now "+sender.status+".")
+		return
+	}
+	if message.Recipient != "" || len(message.Recipients) > 0 {
+		manager.persist(func(store MessageStore) error { return store.Save(*message) })
+		manager.sendToMany(message, manager.encode(message))
+		return
+	}
+	if message.Room == "" {
+		message.Room = sender.room
+	}
+	if !sender.rooms[message.Room] {
+		content := "/You are not in room " + message.Room + "."
+		if message.Room == "" {
+			content = "/You are not in any room, /join or /subscribe to one first."
+		}
+		manager.push(sender, sender.frame(manager.encode(&Message{Type: typeError, Code: codeForbidden, Content: content})))
+		return
+	}
+	if message.Type == typeTyping {
+		// Typing notifications are ephemeral: they carry no content,
+		// are not kept in history and are not echoed to the sender.
+		encoded := manager.encode(&Message{Type: typeTyping, Sender: sender.id, Name: sender.name, Room: message.Room})
+		manager.announce(message.Room, encoded, sender)
+		return
+	}
+	if message.ReplyTo != "" {
+		if room, i := manager.lookup(message.ReplyTo); i < 0 || room != message.Room {
+			manager.push(sender, sender.frame(manager.encode(&Message{Type: typeError, Code: codeNotFound, Content: "/No message with id " + message.ReplyTo + " to reply to in this room."})))
+			return
+		}
+	}
+	encoded := manager.encode(message)
+	manager.record(message)
+	manager.persist(func(store MessageStore) error { return store.Save(*message) })
+	if message.TTL > 0 {
+		manager.schedule(message.ID, message.Room, time.Duration(message.TTL)*time.Second)
+	}
+	delivered := 0
+	for conn := range manager.rooms[message.Room] {
+		if conn == sender && !sender.echo {
+			continue
+		}
+		if manager.push(conn, conn.frame(encoded)) {
+			delivered++
+		} else {
+			manager.undelivered(message, "client "+conn.id+" is not keeping up")
+		}
+	}
+	messagesBroadcast.Inc()
+	manager.logger.Debug("message broadcast", "message", message.ID, "room", message.Room, "recipients", delivered)
+}
+
+// expiry is when a message with a TTL is deleted from its room.
+type expiry struct {
+	room  string
+	timer *time.Timer
+}
+
+// schedule deletes the message with the given id from its room once
+// ttl has passed, replacing an earlier expiry of the same message.
+func (manager *ClientManager) schedule(id, room string, ttl time.Duration) {
+	manager.unschedule(id)
+	manager.expiries[id] = expiry{room: room, timer: time.AfterFunc(ttl, func() {
+		manager.expire <- id
+	})}
+}
+
+// unschedule cancels the expiry of a message, if it has one.
+func (manager *ClientManager) unschedule(id string) {
+	if expiry, ok := manager.expiries[id]; ok {
+		expiry.timer.Stop()
+		delete(manager.expiries, id)
+	}
+}
+
+// change applies an edit or delete to a message in history and tells the
+// room the message was sent to, so clients can update what they show.
+// Only the original sender may change a message.
+func (manager *ClientManager) change(sender *Client, message *Message) {
+	room, i := manager.lookup(message.ID)
+	if i < 0 {
+		manager.push(sender, sender.frame(manager.encode(&Message{Type: typeError, Code: codeNotFound, Content: "/No message with id " + message.ID + " in history."})))
+		return
+	}
+	original := &manager.history[room][i]
+	if original.Sender != sender.id {
+		manager.push(sender, sender.frame(manager.encode(&Message{Type: typeError, Code: codeForbidden, Content: "/You may only change your own messages."})))
+		return
+	}
+
+	event := &Message{Type: message.Type, ID: original.ID, Sender: sender.id, Name: sender.name, Room: original.Room}
+	if message.Type == typeEdit {
+		original.Content = message.Content
+		event.Content = message.Content
+		if message.TTL > 0 {
+			original.TTL, event.TTL = message.TTL, message.TTL
+			manager.schedule(original.ID, original.Room, time.Duration(message.TTL)*time.Second)
+		}
+		edited := *original
+		manager.persist(func(store MessageStore) error { return store.Save(edited) })
+	} else {
+		manager.history[room] = append(manager.history[room][:i], manager.history[room][i+1:]...)
+		manager.unschedule(message.ID)
+		manager.persist(func(store MessageStore) error { return store.Delete(message.ID) })
+	}
+	manager.announce(event.Room, manager.encode(event), nil)
+}
+
+// react toggles the reaction of a client to a message in history and
+// tells the room. Anyone in the room may react, once per reaction.
+func (manager *ClientManager) react(sender *Client, message *Message) {
+	room, i := manager.lookup(message.ID)
+	if i < 0 {
+		manager.push(sender, sender.frame(manager.encode(&Message{Type: typeError, Code: codeNotFound, Content: "/No message with id " + message.ID + " in history."})))
+		return
+	}
+	original := &manager.history[room][i]
+	if !sender.rooms[original.Room] {
+		manager.push(sender, sender.frame(manager.encode(&Message{Type: typeError, Code: codeForbidden, Content: "/You are not in room " + original.Room + "."})))
+		return
+	}
+	reaction := message.Content
+	if _, ok := original.Reactions[reaction]; !ok && len(original.Reactions) >= maxReactions {
+		manager.push(sender, sender.frame(manager.encode(&Message{Type: typeError, Code: codeBadMessage, Content: fmt.Sprintf("/Messages may collect at most %d different reactions.", maxReactions)})))
+		return
+	}
+
+	// The reactions are copied rather than changed in place, since copies
+	// of the message may still be waiting for the store.
+	reactions := make(map[string][]string, len(original.Reactions)+1)
+	removed := false
+	for r, reactors := range original.Reactions {
+		if r != reaction {
+			reactions[r] = reactors
+			continue
+		}
+		for _, id := range reactors {
+			if id == sender.id {
+				removed = true
+			} else {
+				reactions[r] = append(reactions[r], id)
 			}
 		}
 	}
+	if !removed {
+		reactions[reaction] = append(append([]string(nil), original.Reactions[reaction]...), sender.id)
+	}
+	if len(reactions) == 0 {
+		reactions = nil
+	}
+	original.Reactions = reactions
+	reacted := *original
+	manager.persist(func(store MessageStore) error { return store.Save(reacted) })
+	manager.announce(original.Room, manager.encode(&Message{Type: typeReaction, ID: original.ID, Sender: sender.id, Name: sender.name, Room: original.Room, Content: reaction, Reactions: reactions, Removed: removed}), nil)
 }
 
-func (manager *ClientManager) send(message []byte, ignore *Client) {
+// system delivers a server generated message to everyone in its room,
+// or to every connected client when it has no room.
+func (manager *ClientManager) system(message *Message) {
+	encoded := manager.encode(message)
+	if message.Room != "" {
+		manager.announce(message.Room, encoded, nil)
+		return
+	}
 	for conn := range manager.clients {
-		if conn != ignore {
-			conn.send <- message
+		manager.push(conn, conn.frame(encoded))
+	}
+}
+
+// relay delivers a binary payload to everyone in the sender's current room,
+// the sender only if it wants its own messages back like any other.
+// Binary frames are opaque to the server, so they are not kept in history.
+// Clients speaking a binary codec could not tell them from messages and
+// are left out.
+func (manager *ClientManager) relay(sender *Client, data []byte) {
+	binary := frame{messageType: websocket.BinaryMessage, data: data}
+	for conn := range manager.rooms[sender.room] {
+		if conn == sender && !sender.echo {
+			continue
+		}
+		if conn.codec.FrameType() != websocket.BinaryMessage {
+			manager.push(conn, binary)
 		}
 	}
+	messagesBroadcast.Inc()
 }
 
-// The point of this goroutine is to read the socket data and
-// add it to the manager.broadcast for further orchestration
-func (c *Client) read() {
-	defer func() {
-		manager.unregister <- c
-		c.socket.Close()
+// shutdown closes every client connection with a close frame and
+// returns once the manager has let go of all of them and their last
+// messages have been written, or closeWait has passed.
+func (manager *ClientManager) shutdown() {
+	done := make(chan struct{})
+	manager.stop <- done
+	<-done
+
+	flushed := make(chan struct{})
+	go func() {
+		manager.writers.Wait()
+		close(flushed)
 	}()
+	select {
+	case <-flushed:
+	case <-time.After(closeWait):
+	}
+}
 
-	for {
-		_, message, err := c.socket.ReadMessage()
-		// If there was an error reading the websocket data
-		// it probably means the client has disconnected.
-		// If that is the case we need to unregister the client from our server.
-		if err != nil {
-			manager.unregister <- c
-			c.socket.Close()
-			break
+// roster lists the clients in a room sorted by nickname, once for
+// every user however often it is connected, leaving out hidden spectators. The caller must hold manager.mu.
+func (manager *ClientManager) roster(room string) []ClientInfo {
+	clients := make([]ClientInfo, 0, len(manager.rooms[room]))
+	seen := make(map[string]bool)
+	for conn := range manager.rooms[room] {
+		if !seen[conn.id] && !manager.hidden(conn) {
+			seen[conn.id] = true
+			clients = append(clients, conn.info())
 		}
-		jsonMessage, _ := json.Marshal(&Message{Sender: c.id, Content: string(message)})
-		manager.broadcast <- jsonMessage
 	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Name < clients[j].Name })
+	return clients
 }
 
-func (c *Client) write() {
-	defer func() {
-		c.socket.Close()
-	}()
+// count returns the number of connected clients.
+func (manager *ClientManager) count() int {
+	manager.mu.RLock()
+	defer manager.mu.RUnlock()
 
-	for {
-		select {
-		case message, ok := <-c.send:
-			if !ok {
-				c.socket.WriteMessage(websocket.CloseMessage, []byte{})
-				return
+	return len(manager.clients)
+}
+
+// Stats is a snapshot of the connected clients, in total and per room.
+type Stats struct {
+	Clients int            `json:"clients"`
+	Rooms   map[string]int `json:"rooms"`
+}
+
+// stats takes a consistent snapshot of the client and room counts.
+func (manager *ClientManager) stats() Stats {
+	manager.mu.RLock()
+	defer manager.mu.RUnlock()
+
+	stats := Stats{Clients: len(manager.clients), Rooms: make(map[string]int, len(manager.rooms))}
+	for room, clients := range manager.rooms {
+		stats.Rooms[room] = len(clients)
+	}
+	return stats
+}
+
+// listClients returns a snapshot of the connected clients sorted by nickname,
+// including where they connect from and hidden spectators when details is
+// set. Users connected more than once are listed once.
+func (manager *ClientManager) listClients(details bool) []ClientInfo {
+	manager.mu.RLock()
+	defer manager.mu.RUnlock()
+
+	clients := make([]ClientInfo, 0, len(manager.users))
+	for _, conns := range manager.users {
+		conn := conns[0]
+		if manager.hidden(conn) && !details {
+			continue
+		}
+		info := conn.info()
+		if details {
+			info.RemoteAddr, info.UserAgent = conn.remoteAddr, conn.userAgent
+		}
+		clients = append(clients, info)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Name < clients[j].Name })
+	return clients
+}
+
+// page answers a history request with the messages of the requested room,
+// or the current one, sent before the cursor. Clients only see the history
+// of rooms they are in. The page starts out from the in-memory history,
+// which always has the latest messages, and the store, if there is one,
+// fills in older ones. It is queried without holding the lock.
+func (manager *ClientManager) page(conn *Client, request *Message) {
+	limit := request.Limit
+	if limit == 0 {
+		limit = defaultHistoryPage
+	}
+
+	manager.mu.RLock()
+	room := request.Room
+	if room == "" {
+		room = conn.room
+	}
+	subscribed := conn.rooms[room]
+	history := pageOf(manager.history[room], request.Before, limit)
+	manager.mu.RUnlock()
+
+	if !subscribed {
+		manager.sendError(conn, codeForbidden, "You are not in room "+room+".")
+		return
+	}
+	if manager.store != nil && len(history) < limit {
+		before := request.Before
+		if len(history) > 0 {
+			before = history[0].ID
+		}
+		older, err := manager.store.Page(room, before, limit-len(history))
+		if err != nil {
+			manager.logger.Warn("fetching history failed", "room", room, "err", err)
+			manager.sendError(conn, codeServerBusy, "Fetching history failed, try again later.")
+			return
+		}
+		history = append(older, history...)
+	}
+	manager.reply(conn, &Message{Type: typeHistory, Room: room, Before: request.Before, History: history})
+}
+
+// pageOf returns up to limit of the messages before the one with the id
+// before, or the last ones when it is empty. Unknown ids give an empty page.
+// The page is a copy, so it stays intact while history changes.
+func pageOf(history []Message, before string, limit int) []Message {
+	end := len(history)
+	if before != "" {
+		end = -1
+		for i := range history {
+			if history[i].ID == before {
+				end = i
+				break
 			}
+		}
+		if end < 0 {
+			return nil
+		}
+	}
+	start := end - limit
+	if start < 0 {
+		start = 0
+	}
+	return append([]Message(nil), history[start:end]...)
+}
+
+// ConnectionStats describes the traffic of a single connection, for
+// finding the clients that cannot keep up. SendQueue is how many frames
+// are waiting in a send buffer of SendBuffer, and LastActivity when the
+// client last sent something, in Unix milliseconds.
+type ConnectionStats struct {
+	ID               string `json:"id"`
+	Name             string `json:"name"`
+	Room             string `json:"room,omitempty"`
+	RemoteAddr       string `json:"remote_addr"`
+	MessagesReceived int64  `json:"messages_received"`
+	MessagesSent     int64  `json:"messages_sent"`
+	BytesReceived    int64  `json:"bytes_received"`
+	BytesSent        int64  `json:"bytes_sent"`
+	SendQueue        int    `json:"send_queue"`
+	SendBuffer       int    `json:"send_buffer"`
+	LastActivity     int64  `json:"last_activity"`
+}
+
+// connectionStats returns the traffic of every connection, the fullest
+// send buffers first.
+func (manager *ClientManager) connectionStats() []ConnectionStats {
+	manager.mu.RLock()
+	defer manager.mu.RUnlock()
 
-			c.socket.WriteMessage(websocket.TextMessage, message)
+	stats := make([]ConnectionStats, 0, len(manager.clients))
+	for conn := range manager.clients {
+		stats = append(stats, ConnectionStats{
+			ID:               conn.id,
+			Name:             conn.name,
+			Room:             conn.room,
+			RemoteAddr:       conn.remoteAddr,
+			MessagesReceived: conn.stats.messagesReceived.Load(),
+			MessagesSent:     conn.stats.messagesSent.Load(),
+			BytesReceived:    conn.stats.bytesReceived.Load(),
+			BytesSent:        conn.stats.bytesSent.Load(),
+			SendQueue:        len(conn.send),
+			SendBuffer:       cap(conn.send),
+			LastActivity:     conn.stats.lastActivity.Load(),
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].SendQueue != stats[j].SendQueue {
+			return stats[i].SendQueue > stats[j].SendQueue
 		}
+		return stats[i].ID < stats[j].ID
+	})
+	return stats
+}
+
+// identity describes the client as the other clients see it.
+func (manager *ClientManager) identity(conn *Client) ClientInfo {
+	manager.mu.RLock()
+	defer manager.mu.RUnlock()
+
+	return conn.info()
+}
+
+// listRooms returns the number of clients in every room that is not empty.
+func (manager *ClientManager) listRooms() map[string]int {
+	manager.mu.RLock()
+	defer manager.mu.RUnlock()
+
+	rooms := make(map[string]int, len(manager.rooms))
+	for room, clients := range manager.rooms {
+		if len(clients) > 0 {
+			rooms[room] = len(clients)
+		}
+	}
+	return rooms
+}
+
+// mentions resolves the nicknames mentioned in content to client ids,
+// so the mentioned clients can highlight the message. Nicknames nobody
+// goes by are ignored.
+func (manager *ClientManager) mentions(content string) []string {
+	names := mentionPattern.FindAllStringSubmatch(content, -1)
+	if len(names) == 0 {
+		return nil
+	}
+
+	manager.mu.RLock()
+	defer manager.mu.RUnlock()
+
+	var ids []string
+	seen := make(map[string]bool)
+	for _, name := range names {
+		for conn := range manager.clients {
+			if strings.EqualFold(conn.name, name[1]) && !seen[conn.id] {
+				seen[conn.id] = true
+				ids = append(ids, conn.id)
+			}
+		}
+	}
+	return ids
+}
+
+// resolve returns the id of the client going by the given nickname.
+func (manager *ClientManager) resolve(name string) (string, bool) {
+	manager.mu.RLock()
+	defer manager.mu.RUnlock()
+
+	for conn := range manager.clients {
+		if strings.EqualFold(conn.name, name) {
+			return conn.id, true
+		}
+	}
+	return "", false
+}
+
+// rename changes the nickname of a client and tells its rooms about it.
+// Empty, overly long and already taken nicknames are rejected.
+func (manager *ClientManager) rename(conn *Client, name string) error {
+	if name == "" {
+		return errors.New("nickname must not be empty")
+	}
+	if len(name) > maxNameLength {
+		return fmt.Errorf("nickname must be at most %d characters long", maxNameLength)
+	}
+
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	if _, ok := manager.clients[conn]; !ok {
+		return nil
+	}
+	for other := range manager.clients {
+		if other.id != conn.id && strings.EqualFold(other.name, name) {
+			return fmt.Errorf("nickname %s is already taken", name)
+		}
+	}
+	old := conn.name
+	for _, other := range manager.connectionsFor(conn.id) {
+		other.name = name
+	}
+	if manager.hidden(conn) {
+		return nil
+	}
+	for _, room := range conn.subscriptions() {
+		manager.announce(room, manager.encode(&Message{Sender: conn.id, Name: name, Room: room, Content: "/" + old + " is now known as " + name + "."}), nil)
+	}
+	return nil
+}
+
+// reply delivers a message to a single client from outside the start
+// goroutine. Holding the lock guarantees the send channel is not closed
+// underneath us, and a full buffer drops the reply instead of blocking.
+func (manager *ClientManager) reply(conn *Client, message *Message) {
+	encoded := manager.encode(message)
+
+	manager.mu.RLock()
+	defer manager.mu.RUnlock()
+
+	if _, ok := manager.clients[conn]; !ok {
+		return
+	}
+	select {
+	case conn.send <- conn.frame(encoded):
+	default:
+		messagesDropped.Inc()
+	}
+}
+
+// sendError tells a single client that something went wrong. Errors are
+// never broadcast nor kept in history.
+func (manager *ClientManager) sendError(conn *Client, code, message string) {
+	manager.reply(conn, &Message{Type: typeError, Code: code, Content: "/" + message})
+}
+
+// undelivered hands a message that could not be delivered to the
+// dead-letter sink, if there is one.
+func (manager *ClientManager) undelivered(message *Message, reason string) {
+	if manager.deadLetters != nil {
+		manager.deadLetters.Undelivered(*message, reason)
+	}
+}
+
+// The helpers below expect the caller to hold manager.mu.
+
+// announce delivers a message to every client in the room except the
+// ignored one without ever blocking the manager. Slow clients are
+// handled by push, just like during a broadcast.
+func (manager *ClientManager) announce(room string, message *envelope, ignore *Client) {
+	for conn := range manager.rooms[room] {
+		if conn == ignore {
+			continue
+		}
+		manager.push(conn, conn.frame(message))
+	}
+}
+
+// announcePresence sends a presence event for the client to every room
+// it is in, unless the client is a hidden spectator.
+func (manager *ClientManager) announcePresence(kind string, conn *Client, content string) {
+	if manager.hidden(conn) {
+		return
+	}
+	for _, room := range conn.subscriptions() {
+		manager.announce(room, manager.presence(kind, conn, room, content), nil)
+	}
+}
+
+// announceUser sends a presence event for the client to the rooms it is
+// in that no other connection of the same user is in, so the occupants
+// hear of a user coming or going once, however many tabs it has open.
+func (manager *ClientManager) announceUser(kind string, conn *Client, content string) {
+	if manager.hidden(conn) {
+		return
+	}
+	for _, room := range conn.subscriptions() {
+		if manager.alone(conn, room) {
+			manager.announce(room, manager.presence(kind, conn, room, content), nil)
+		}
+	}
+}
+
+// alone reports whether no other connection of the client's user is in room.
+func (manager *ClientManager) alone(conn *Client, room string) bool {
+	for _, other := range manager.connectionsFor(conn.id) {
+		if other != conn && other.rooms[room] {
+			return false
+		}
+	}
+	return true
+}
+
+// hidden reports whether the client is a spectator nobody should notice.
+func (manager *ClientManager) hidden(conn *Client) bool {
+	return conn.readOnly && manager.hideSpectators
+}
+
+// record appends a broadcast message to the history of its room,
+// dropping the oldest messages once more than historySize are kept.
+// Direct messages and whispers are private and never kept.
+func (manager *ClientManager) record(message *Message) {
+	if manager.historySize <= 0 || private(message) {
+		return
+	}
+	history := append(manager.history[message.Room], *message)
+	if extra := len(history) - manager.historySize; extra > 0 {
+		history = append(history[:0], history[extra:]...)
+	}
+	manager.history[message.Room] = history
+}
+
+// persist hands a change to the message store, if there is one.
+func (manager *ClientManager) persist(change func(MessageStore) error) {
+	if manager.store == nil {
+		return
+	}
+	if err := change(manager.store); err != nil {
+		manager.logger.Warn("persisting messages failed", "err", err)
+	}
+}
+
+// lookup finds the message with the given id in history and returns its
+// room and index, or -1 as index when it is not there.
+func (manager *ClientManager) lookup(id string) (string, int) {
+	for room, history := range manager.history {
+		for i := range history {
+			if history[i].ID == id {
+				return room, i
+			}
+		}
+	}
+	return "", -1
+}
+
+// replay sends the history of a room to the client in chronological
+// order. Messages that do not fit in the send buffer are skipped.
+func (manager *ClientManager) replay(conn *Client, room string) {
+	history := manager.history[room]
+	for i := range history {
+		select {
+		case conn.send <- conn.frame(manager.encode(&history[i])):
+		default:
+			messagesDropped.Inc()
+		}
+	}
+}
+
+// push queues a frame for the client without blocking and reports whether
+// it was queued. What happens when the send buffer is full depends on the
+// overflow policy. By default the frame is dropped, and a client whose
+// buffer stays full for slowThreshold sends in a row within slowWindow is
+// considered too slow and removed. Any successful send resets the count.
+func (manager *ClientManager) push(conn *Client, f frame) bool {
+	select {
+	case conn.send <- f:
+		conn.failures = 0
+		return true
+	default:
+	}
+
+	messagesDropped.Inc()
+	overflowDrops.WithLabelValues(manager.overflowPolicy).Inc()
+	switch manager.overflowPolicy {
+	case overflowDropNewest:
+		return false
+	case overflowDropOldest:
+		// Only the start goroutine and reply queue frames, and neither
+		// can while we hold the lock, so the slot freed here stays free.
+		select {
+		case <-conn.send:
+		default:
+		}
+		select {
+		case conn.send <- f:
+			return true
+		default:
+			return false
+		}
+	}
+
+	now := time.Now()
+	if conn.failures == 0 || now.Sub(conn.firstFailure) > slowWindow {
+		conn.failures, conn.firstFailure = 0, now
+	}
+	conn.failures++
+	if conn.failures >= manager.slowThreshold {
+		manager.logger.Warn("dropping slow client", "client", conn.id, "failures", conn.failures, "since", conn.firstFailure)
+		manager.remove(conn)
+	}
+	return false
+}
+
+// enter adds the client to the given room, creating the room, with the
+// history the store kept of it, if needed.
+func (manager *ClientManager) enter(conn *Client, room string) {
+	if manager.rooms[room] == nil {
+		manager.rooms[room] = make(map[*Client]bool)
+		manager.reload(room)
+	}
+	manager.rooms[room][conn] = true
+}
+
+// leave takes the client out of the given room, dropping the room, its
+// history and its password once nobody is left in it. Persisted history
+// outlives the room, so whoever enters it next is replayed what the store
+// kept, unless the room had a password: whoever enters it next sets a new
+// one, so the persisted history goes along with the old one, and so does
+// the room in the sessions of those who knew it. The client still
+// remembers the room, so it can say goodbye there once it is gone.
+func (manager *ClientManager) leave(conn *Client, room string) {
+	delete(manager.rooms[room], conn)
+	if len(manager.rooms[room]) == 0 {
+		delete(manager.rooms, room)
+		delete(manager.history, room)
+		if _, protected := manager.passwords[room]; protected {
+			delete(manager.passwords, room)
+			manager.forget(room)
+			manager.revoke(room)
+		}
+	}
+}
+
+// forget drops the history of a room, from the store as well, and the
+// messages waiting to expire there.
+func (manager *ClientManager) forget(room string) {
+	delete(manager.history, room)
+	manager.persist(func(store MessageStore) error { return store.Clear(room) })
+	for id, expiry := range manager.expiries {
+		if expiry.room == room {
+			manager.unschedule(id)
+		}
+	}
+}
+
+// part takes a client that stays connected out of a room and tells
+// those left behind.
+func (manager *ClientManager) part(conn *Client, room string) {
+	manager.leave(conn, room)
+	delete(conn.rooms, room)
+	if conn.room == room {
+		conn.room = ""
+	}
+	if !manager.hidden(conn) && manager.alone(conn, room) {
+		manager.announce(room, manager.presence(typeLeave, conn, room, "/"+conn.name+" has left the room."), nil)
+	}
+}
+
+// subscriptions returns the rooms the client is in, sorted by name.
+func (conn *Client) subscriptions() []string {
+	rooms := make([]string, 0, len(conn.rooms))
+	for room := range conn.rooms {
+		rooms = append(rooms, room)
+	}
+	sort.Strings(rooms)
+	return rooms
+}
+
+// remove cancels the client's context, which stops both of its goroutines,
+// and forgets about the client. It reports whether the client was still
+// registered. Nothing is queued for a removed client anymore, since every
+// send happens under the lock after checking the client is registered.
+func (manager *ClientManager) remove(conn *Client) bool {
+	if _, ok := manager.clients[conn]; !ok {
+		return false
+	}
+	conn.cancel()
+	delete(manager.clients, conn)
+	var others []*Client
+	for _, other := range manager.users[conn.id] {
+		if other != conn {
+			others = append(others, other)
+		}
+	}
+	if len(others) == 0 {
+		delete(manager.users, conn.id)
+	} else {
+		manager.users[conn.id] = others
+	}
+	connectedClients.Dec()
+	for room := range conn.rooms {
+		manager.leave(conn, room)
+	}
+	return true
+}
+
+// suggestRetry tells a client the server is going away and when it may
+// come back, first with a retry message and then with the close frame,
+// so clients spread out their reconnects instead of all retrying at once.
+func (manager *ClientManager) suggestRetry(conn *Client, after time.Duration) {
+	seconds := int(after / time.Second)
+	manager.push(conn, conn.frame(manager.encode(&Message{Type: typeRetry, RetryAfter: seconds, Content: fmt.Sprintf("/The server is going away, try again in %d seconds.", seconds)})))
+	conn.closeAfterDrain(websocket.CloseServiceRestart, fmt.Sprintf("retry after %ds", seconds))
+}
+
+// kick disconnects every connection of the client with the given id
+// and tells its rooms.
+func (manager *ClientManager) kick(id string) error {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	conns := manager.connectionsFor(id)
+	if len(conns) == 0 {
+		return fmt.Errorf("no client with id %s is connected", id)
+	}
+	for _, conn := range conns {
+		manager.logger.Info("kicking client", "client", conn.id, "remote", conn.remoteAddr)
+		closeWith(conn, websocket.ClosePolicyViolation, "kicked")
+		manager.remove(conn)
+	}
+	manager.announcePresence(typeLeave, conns[0], "/"+conns[0].name+" has been kicked.")
+	return nil
+}
+
+// errNoSuchRoom is returned for rooms nobody is in.
+var errNoSuchRoom = errors.New("no such room")
+
+// maxCloseReason is the longest reason, in bytes, a close frame can carry.
+const maxCloseReason = 123
+
+// kickRoom disconnects every client in the room, telling them why in the
+// close frame, which empties and thereby removes the room. Nobody is left
+// in it to be told, but the other rooms of users with no connection left
+// learn that they have been kicked.
+func (manager *ClientManager) kickRoom(room, reason string) error {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	occupants, ok := manager.rooms[room]
+	if !ok {
+		return fmt.Errorf("%w %s", errNoSuchRoom, room)
+	}
+	if len(reason) > maxCloseReason {
+		reason = strings.ToValidUTF8(reason[:maxCloseReason], "")
+	}
+	manager.logger.Info("kicking room", "room", room, "clients", len(occupants), "reason", reason)
+	// Everyone is out before anything is announced, so the announcements
+	// cannot reach those still waiting to be kicked.
+	kicked := make([]*Client, 0, len(occupants))
+	for conn := range occupants {
+		kicked = append(kicked, conn)
+	}
+	for _, conn := range kicked {
+		closeWith(conn, websocket.ClosePolicyViolation, reason)
+		manager.remove(conn)
+	}
+	announced := make(map[string]bool)
+	for _, conn := range kicked {
+		if !announced[conn.id] && len(manager.connectionsFor(conn.id)) == 0 {
+			announced[conn.id] = true
+			manager.announcePresence(typeLeave, conn, "/"+conn.name+" has been kicked.")
+		}
+	}
+	return nil
+}
+
+// renameRoom moves a room, with its occupants, history and password, to
+// a new name and tells the occupants. The new name must not be in use.
+func (manager *ClientManager) renameRoom(old, name string) error {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	occupants, ok := manager.rooms[old]
+	if !ok {
+		return fmt.Errorf("%w %s", errNoSuchRoom, old)
+	}
+	if _, taken := manager.rooms[name]; taken || len(manager.history[name]) > 0 || manager.persisted(name) {
+		return fmt.Errorf("room %s already exists", name)
+	}
+	manager.logger.Info("renaming room", "from", old, "to", name, "clients", len(occupants))
+
+	manager.rooms[name] = occupants
+	delete(manager.rooms, old)
+	for conn := range occupants {
+		delete(conn.rooms, old)
+		conn.rooms[name] = true
+		if conn.room == old {
+			conn.room = name
+		}
+	}
+	if password, ok := manager.passwords[old]; ok {
+		manager.passwords[name] = password
+		delete(manager.passwords, old)
+	}
+	if history, ok := manager.history[old]; ok {
+		for i := range history {
+			history[i].Room = name
+		}
+		manager.history[name] = history
+		delete(manager.history, old)
+	}
+	for id, expiry := range manager.expiries {
+		if expiry.room == old {
+			expiry.room = name
+			manager.expiries[id] = expiry
+		}
+	}
+	for id, session := range manager.sessions {
+		if session.room == old {
+			session.room = name
+		}
+		for i := range session.rooms {
+			if session.rooms[i] == old {
+				session.rooms[i] = name
+			}
+		}
+		manager.sessions[id] = session
+	}
+	manager.persist(func(store MessageStore) error { return store.Rename(old, name) })
+	manager.announce(name, manager.encode(&Message{Type: typeRename, Room: name, OldRoom: old, Content: "/Room " + old + " is now called " + name + "."}), nil)
+	return nil
+}
+
+// persisted reports whether the store kept messages of a room nobody is
+// in, which a rename must not merge with those of another room.
+func (manager *ClientManager) persisted(room string) bool {
+	if manager.store == nil {
+		return false
+	}
+	messages, err := manager.store.Page(room, "", 1)
+	return err == nil && len(messages) > 0
+}
+
+// clearHistory forgets the history of a room and tells everyone in it to
+// clear their view as well. Messages waiting to expire are forgotten too.
+func (manager *ClientManager) clearHistory(room string) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	manager.logger.Info("clearing room history", "room", room, "messages", len(manager.history[room]))
+	manager.forget(room)
+	manager.announce(room, manager.encode(&Message{Type: typeClear, Room: room, Content: "/The history of " + room + " was cleared."}), nil)
+}
+
+// currentRoom returns the room the client last joined.
+func (manager *ClientManager) currentRoom(conn *Client) string {
+	manager.mu.RLock()
+	defer manager.mu.RUnlock()
+
+	return conn.room
+}
+
+// mute keeps the client with the given id from being heard for the
+// given duration, and tells the client so. The mute belongs to the id,
+// so it holds for every connection and survives reconnecting, and ends
+// by itself once the duration has passed. Mutes that ended are forgotten
+// in passing.
+func (manager *ClientManager) mute(id string, duration time.Duration) error {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	conns := manager.connectionsFor(id)
+	if len(conns) == 0 {
+		return fmt.Errorf("no client with id %s is connected", id)
+	}
+	now := time.Now()
+	for other, until := range manager.mutes {
+		if now.After(until) {
+			delete(manager.mutes, other)
+		}
+	}
+	manager.logger.Info("muting client", "client", id, "duration", duration)
+	manager.mutes[id] = now.Add(duration)
+	notice := manager.encode(&Message{Content: "/You have been muted for " + duration.String() + "."})
+	for _, conn := range conns {
+		manager.push(conn, conn.frame(notice))
+	}
+	return nil
+}
+
+// muted reports whether the client is currently muted.
+func (manager *ClientManager) muted(conn *Client) bool {
+	manager.mu.RLock()
+	defer manager.mu.RUnlock()
+
+	return time.Now().Before(manager.mutes[conn.id])
+}
+
+// limiter returns a rate limiter for a new client, or one that never
+// throttles when the configured rate is not positive.
+func (manager *ClientManager) limiter() *rate.Limiter {
+	if manager.messageRate <= 0 {
+		return rate.NewLimiter(rate.Inf, 0)
+	}
+	return rate.NewLimiter(rate.Limit(manager.messageRate), manager.messageBurst)
+}
+
+// connectionsFor returns every connection of the user with the given id.
+// The slice is replaced rather than modified when connections come and
+// go, so callers may keep iterating it while removing clients.
+func (manager *ClientManager) connectionsFor(userID string) []*Client {
+	return manager.users[userID]
+}
+
+// sendToMany delivers a direct message once to each of its recipients
+// and echoes it back to the sender unless it opted out, or is one of the
+// recipients anyway. The connection the message came from receives an ack
+// for every recipient the message is queued for and a nack explaining why
+// for every other one, which the user's other connections have no use for.
+// Both carry the ClientMsgID of the message and follow the echo, so the
+// sender can match them to what it sent either way. Neither acks nor
+// nacks are kept in history.
+func (manager *ClientManager) sendToMany(message *Message, encoded *envelope) {
+	sender := message.client
+	recipients := message.Recipients
+	if message.Recipient != "" {
+		recipients = append([]string{message.Recipient}, recipients...)
+	}
+	seen := make(map[string]bool, len(recipients))
+	var receipts []*Message
+	delivered := false
+	for _, id := range recipients {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		if err := manager.sendTo(encoded, id); err != nil {
+			code := codeUnknownRecipient
+			if errors.Is(err, errSlowClient) {
+				code = codeRecipientBusy
+			}
+			manager.undelivered(message, err.Error())
+			receipts = append(receipts, &Message{Type: typeNack, ID: message.ID, ClientMsgID: message.ClientMsgID, Recipient: id, Code: code, Content: "/" + err.Error()})
+			continue
+		}
+		delivered = true
+		receipts = append(receipts, &Message{Type: typeAck, ID: message.ID, ClientMsgID: message.ClientMsgID, Recipient: id})
+	}
+	if delivered && !seen[message.Sender] {
+		for _, conn := range manager.connectionsFor(message.Sender) {
+			if conn.echo {
+				manager.push(conn, conn.frame(encoded))
+			}
+		}
+	}
+	for _, receipt := range receipts {
+		manager.push(sender, sender.frame(manager.encode(receipt)))
+	}
+}
+
+// sendTo queues a message for every connection of the client with the
+// given id. It fails when no such client is connected or none of its send
+// buffers has room. Like broadcasts it goes through push, so a recipient
+// that keeps missing direct messages is dropped as too slow instead of
+// stalling the manager.
+func (manager *ClientManager) sendTo(message *envelope, recipientID string) error {
+	conns := manager.connectionsFor(recipientID)
+	if len(conns) == 0 {
+		return fmt.Errorf("no client with id %s is connected", recipientID)
+	}
+	queued := false
+	for _, conn := range conns {
+		if manager.push(conn, conn.frame(message)) {
+			queued = true
+		}
+	}
+	if !queued {
+		return fmt.Errorf("client %s is %w", recipientID, errSlowClient)
+	}
+	return nil
+}
+
+// The point of this goroutine is to read the socket data and
+// add it to the manager.broadcast for further orchestration.
+// It exits when the socket fails, which write causes by closing
+// the socket once the client's context is cancelled.
+func (c *Client) read() {
+	// Unregistering cancels the client's context, upon which write sends
+	// the close frame and closes the socket.
+	defer func() {
+		c.manager.unregister <- c
+	}()
+	defer c.recoverPanic("read")
+
+	c.socket.SetReadLimit(maxMessageSize)
+
+	// Every pong pushes the read deadline further, so a client that stops
+	// answering pings makes ReadMessage fail and gets unregistered.
+	c.lastActivity = time.Now()
+	c.extendDeadline()
+	c.socket.SetPongHandler(func(string) error {
+		c.extendDeadline()
+		return nil
+	})
+	// Clients may ping as well, e.g. to keep the connection open through
+	// a proxy. Unlike pongs, which clients send whenever we ping them,
+	// pings are sent on purpose and count as activity. The pong is written
+	// with WriteControl, the one write allowed next to those of write.
+	c.socket.SetPingHandler(func(data string) error {
+		c.touch()
+		err := c.socket.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(writeWait))
+		var netErr net.Error
+		if errors.Is(err, websocket.ErrCloseSent) || errors.As(err, &netErr) && netErr.Timeout() {
+			return nil
+		}
+		return err
+	})
+	// A close frame from the client makes ReadMessage fail with its code,
+	// which is logged below. Echoing the code is left to write, which sends
+	// the close frame once the client has been unregistered.
+	c.socket.SetCloseHandler(func(code int, text string) error {
+		closeWith(c, code, "")
+		return nil
+	})
+
+	for {
+		messageType, message, err := c.socket.ReadMessage()
+		// If there was an error reading the websocket data
+		// it probably means the client has disconnected.
+		// If that is the case we need to unregister the client from our server,
+		// which the deferred function does exactly once.
+		if err != nil {
+			if c.idle() {
+				c.manager.logger.Info("dropping idle client", "client", c.id, "since", c.lastActivity)
+				closeWith(c, websocket.ClosePolicyViolation, "idle timeout")
+				break
+			}
+			var closed *websocket.CloseError
+			switch {
+			case errors.As(err, &closed) && closed.Code != websocket.CloseAbnormalClosure:
+				level := slog.LevelDebug
+				if closed.Code != websocket.CloseNormalClosure && closed.Code != websocket.CloseGoingAway {
+					level = slog.LevelInfo
+				}
+				c.manager.logger.Log(context.Background(), level, "client closed the connection", "client", c.id, "code", closed.Code, "reason", closed.Text)
+			case websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure):
+				c.manager.logger.Warn("reading from client failed", "client", c.id, "err", err)
+			default:
+				c.manager.logger.Debug("client closed the connection", "client", c.id, "err", err)
+			}
+			break
+		}
+		messagesReceived.Inc()
+		c.stats.messagesReceived.Add(1)
+		c.stats.bytesReceived.Add(int64(len(message)))
+		c.touch()
+		parsed := &Message{Sender: c.id, Binary: message}
+		if messageType != websocket.BinaryMessage || c.codec.FrameType() == websocket.BinaryMessage {
+			if parsed, err = c.parse(messageType, message); err != nil {
+				c.manager.sendError(c, codeBadMessage, err.Error())
+				continue
+			}
+		}
+		if parsed, err = c.manager.intercept(c, parsed); err != nil {
+			c.manager.sendRejection(c, err)
+			continue
+		} else if parsed == nil {
+			continue
+		}
+		if parsed.Binary != nil {
+			if c.readOnly {
+				c.manager.sendError(c, codeForbidden, "Spectators may watch but not post.")
+			} else if !c.manager.muted(c) {
+				c.submit(parsed)
+			}
+			continue
+		}
+		if parsed.Type == typeHistory {
+			c.manager.page(c, parsed)
+			continue
+		}
+		if isCommand(parsed) {
+			if err := c.dispatch(parsed); errors.Is(err, errClosing) {
+				return
+			} else if err != nil {
+				c.manager.sendCommandError(c, err)
+			}
+			continue
+		}
+		c.post(parsed)
+	}
+}
+
+// post passes a message the client sent on for delivery, unless the
+// client may not post. Muted clients are not told their messages go
+// nowhere. Messages sent again with the idempotency key of one already
+// posted are only acked once more.
+func (c *Client) post(parsed *Message) {
+	if parsed.Type == typeWhisper {
+		id, ok := c.manager.resolve(parsed.Recipient)
+		if !ok {
+			c.manager.sendError(c, codeUnknownRecipient, parsed.Recipient+" is not online.")
+			return
+		}
+		parsed.Recipient = id
+	}
+	// Shortcodes are expanded only now, so a shortcut never shadows a command.
+	parsed.Content = expandShortcodes(parsed.Content)
+	// Spectators may use commands, but nothing they say is passed on.
+	if c.readOnly {
+		c.manager.sendError(c, codeForbidden, "Spectators may watch but not post.")
+		return
+	}
+	if c.manager.muted(c) {
+		c.manager.undelivered(parsed, "sender is muted")
+		return
+	}
+	if key := parsed.ClientMsgID; key != "" {
+		if id, ok := c.manager.dedup.lookup(c.id, key); ok {
+			c.manager.logger.Debug("dropping duplicate message", "client", c.id, "client_msg_id", key, "message", id)
+			c.manager.reply(c, &Message{Type: typeAck, ID: id, ClientMsgID: key})
+			return
+		}
+		// Direct messages are acked once per recipient by sendToMany.
+		if c.submit(parsed) {
+			c.manager.dedup.remember(c.id, key, parsed.ID)
+			if !private(parsed) {
+				c.manager.reply(c, &Message{Type: typeAck, ID: parsed.ID, ClientMsgID: key})
+			}
+		}
+		return
+	}
+	c.submit(parsed)
+}
+
+// touch records that the client is active and extends the read deadline.
+func (c *Client) touch() {
+	c.lastActivity = time.Now()
+	c.stats.lastActivity.Store(c.lastActivity.UnixMilli())
+	c.extendDeadline()
+}
+
+// extendDeadline sets the read deadline to when the next pong is due or,
+// if that comes first, to when the client will have been idle for too long.
+// Messages and pings count as activity, pongs do not: they answer our
+// pings every pingPeriod, so counting them would keep every live
+// connection from ever being idle.
+func (c *Client) extendDeadline() {
+	deadline := time.Now().Add(pongWait)
+	if timeout := c.manager.idleTimeout; timeout > 0 && c.lastActivity.Add(timeout).Before(deadline) {
+		deadline = c.lastActivity.Add(timeout)
+	}
+	c.socket.SetReadDeadline(deadline)
+}
+
+// idle reports whether the client has sent no message or ping for
+// idleTimeout.
+func (c *Client) idle() bool {
+	return c.manager.idleTimeout > 0 && time.Since(c.lastActivity) >= c.manager.idleTimeout
+}
+
+// submit hands a message to the manager for delivery, giving up once the
+// client has been removed so a closing client never blocks. While the
+// broadcast queue is full only this reader waits, for at most queueWait,
+// before the message is dropped and the client told so. It reports
+// whether the message was handed over.
+func (c *Client) submit(message *Message) bool {
+	message.client = c
+	select {
+	case c.manager.broadcast <- message:
+		return true
+	default:
+	}
+
+	timer := time.NewTimer(queueWait)
+	defer timer.Stop()
+	select {
+	case c.manager.broadcast <- message:
+		return true
+	case <-timer.C:
+		c.manager.logger.Warn("broadcast queue is full, dropping message", "client", c.id, "message", message.ID)
+		c.manager.undelivered(message, "broadcast queue is full")
+		c.manager.sendError(c, codeServerBusy, "The server is busy, your message was dropped.")
+	case <-c.ctx.Done():
+	}
+	return false
+}
+
+// fromClient copies the fields of a message clients may set, so those
+// only the server sets, such as the reactions to a message or the
+// occupants of a room, cannot be forged.
+func (m *Message) fromClient() *Message {
+	return &Message{
+		ID:          m.ID,
+		Type:        m.Type,
+		Recipient:   m.Recipient,
+		Recipients:  m.Recipients,
+		Room:        m.Room,
+		Content:     m.Content,
+		ReplyTo:     m.ReplyTo,
+		Attachments: m.Attachments,
+		TTL:         m.TTL,
+		ClientMsgID: m.ClientMsgID,
+		Before:      m.Before,
+		Limit:       m.Limit,
+	}
+}
+
+// parse turns the raw socket data into a Message sent by this client.
+// Clients may send either a JSON encoded Message, which allows setting
+// a recipient, or plain text which is broadcast as is. Binary frames of
+// clients speaking MessagePack hold an encoded Message too. Data that looks
+// like a JSON object but does not decode, server-only message types and
+// overly long content are rejected. Only the fields clients may set are
+// kept. Every message gets a fresh id, except edits and deletes whose id
+// names the message they change.
+func (c *Client) parse(messageType int, data []byte) (*Message, error) {
+	decoded := &Message{}
+	if messageType == websocket.BinaryMessage {
+		if err := c.codec.Unmarshal(data, decoded); err != nil {
+			return nil, fmt.Errorf("malformed %s message", c.codec.Name())
+		}
+	} else if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		if err := json.Unmarshal(trimmed, decoded); err != nil {
+			return nil, errors.New("malformed JSON message")
+		}
+	} else {
+		decoded.Content = string(data)
+	}
+	message := decoded.fromClient()
+	if !clientTypes[message.Type] {
+		return nil, fmt.Errorf("unsupported message type %q", message.Type)
+	}
+	if utf8.RuneCountInString(message.Content) > maxContentLength {
+		return nil, fmt.Errorf("message content must be at most %d characters long", maxContentLength)
+	}
+	if referenceTypes[message.Type] {
+		if message.ID == "" {
+			return nil, fmt.Errorf("%s messages must carry the id of the message they refer to", message.Type)
+		}
+	} else {
+		message.ID = uuid.NewV4().String()
+	}
+	if message.Type == typeStatus && !statuses[message.Content] {
+		return nil, fmt.Errorf("unknown status %q, use online, away or busy", message.Content)
+	}
+	if message.Type == typeWhisper && message.Recipient == "" {
+		return nil, errors.New("whispers must carry the nickname of their recipient")
+	}
+	if message.Limit < 0 || message.Limit > maxHistoryPage {
+		return nil, fmt.Errorf("limit must be between 0 and %d", maxHistoryPage)
+	}
+	if len(message.ClientMsgID) > maxClientMsgIDLength {
+		return nil, fmt.Errorf("client_msg_id must be at most %d bytes long", maxClientMsgIDLength)
+	}
+	if message.TTL < 0 || time.Duration(message.TTL)*time.Second > maxTTL {
+		return nil, fmt.Errorf("ttl must be between 0 and %d seconds", int(maxTTL/time.Second))
+	}
+	// Direct messages and whispers are persisted but never expire, so a
+	// TTL would not make them disappear.
+	if message.TTL > 0 && (message.Recipient != "" || len(message.Recipients) > 0) {
+		return nil, errors.New("only room messages may have a ttl")
+	}
+	if len(message.Recipients) > maxRecipients {
+		return nil, fmt.Errorf("messages may have at most %d recipients", maxRecipients)
+	}
+	if len(message.Attachments) > maxAttachments {
+		return nil, fmt.Errorf("messages may carry at most %d attachments", maxAttachments)
+	}
+	for _, ref := range message.Attachments {
+		if !validAttachment(ref) {
+			return nil, fmt.Errorf("attachment %q is neither an upload id nor an http(s) URL", ref)
+		}
+	}
+	if message.Type == typeEdit && message.Content == "" {
+		return nil, errors.New("edits must carry the new content")
+	}
+	if message.Type == typeReact && (message.Content == "" || len(message.Content) > maxReactionLength || strings.ContainsFunc(message.Content, unicode.IsSpace)) {
+		return nil, fmt.Errorf("reactions must be a single emoji or word of at most %d bytes", maxReactionLength)
+	}
+	message.Sender = c.id
+	message.Timestamp = now()
+	return message, nil
+}
+
+// roomPassword protects a room. The hash is salted with the name the room
+// had when it was protected, which stays the same when it is renamed.
+type roomPassword struct {
+	salt string
+	hash []byte
+}
+
+// hashPassword hashes a room password, salted with the room name.
+func hashPassword(room, password string) []byte {
+	sum := sha256.Sum256([]byte(room + "\x00" + password))
+	return sum[:]
+}
+
+// mentionPattern matches "@nickname" mentions, leaving out punctuation
+// that commonly follows them such as in "thanks @bob!".
+var mentionPattern = regexp.MustCompile(`@([^\s@,.:;!?]+)`)
+
+// write delivers queued messages to the socket and pings the client
+// periodically so dead connections are detected by the read deadline.
+// Every write has a deadline, so a client that stopped reading cannot
+// hold this goroutine forever. On a write error the socket is closed,
+// which makes read fail and unregister the client. Once the client's
+// context is cancelled a close frame is sent and the socket closed.
+// The close frame is the one given to closeWith or closeAfterDrain, and
+// for the latter, such as for clients that quit, what is still queued is
+// sent first, while forced disconnects close right away.
+// Text messages that queued up while writing are sent together as a
+// single JSON array frame to save on syscalls; pings stay separate.
+func (c *Client) write() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.socket.Close()
+		c.manager.writers.Done()
+	}()
+	defer c.recoverPanic("write")
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			closeWith(c, websocket.CloseGoingAway, "disconnected by the server")
+			closing := c.closing.Load()
+			if closing.drain && !c.drain() {
+				return
+			}
+			c.socket.SetWriteDeadline(time.Now().Add(closeWait))
+			c.socket.WriteMessage(websocket.CloseMessage, closing.message)
+			return
+		case next := <-c.send:
+			var pending *frame
+			if next.messageType == c.codec.FrameType() && len(c.send) > 0 {
+				next, pending = c.batch(next)
+			}
+			if err := c.writeFrame(next); err != nil {
+				c.handleWriteErr(err)
+				return
+			}
+			if pending == nil {
+				continue
+			}
+			if err := c.writeFrame(*pending); err != nil {
+				c.handleWriteErr(err)
+				return
+			}
+		case <-ticker.C:
+			c.socket.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.socket.WriteMessage(websocket.PingMessage, nil); err != nil {
+				c.handleWriteErr(err)
+				return
+			}
+		}
+	}
+}
+
+// handleWriteErr logs why writing to a client failed, quietly when the
+// client is simply gone and as an error otherwise. write returns after
+// it and closes the socket, which ends read as well, so the client is
+// unregistered exactly once, by read, whatever went wrong.
+func (c *Client) handleWriteErr(err error) {
+	if clientGone(err) {
+		c.manager.logger.Debug("client is gone", "client", c.id, "err", err)
+	} else {
+		c.manager.logger.Error("writing to client failed", "client", c.id, "err", err)
+	}
+	c.cancel()
+}
+
+// clientGone reports whether a write failed because the client closed
+// the connection or it was closed already, rather than for another reason.
+func clientGone(err error) bool {
+	return websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) ||
+		errors.Is(err, websocket.ErrCloseSent) || errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// recoverPanic, deferred by read and write, keeps a panic in one of the
+// client's goroutines from taking down the server. The panic is logged and
+// the client closed with an internal error, after which it is unregistered
+// like any other client whose connection ends.
+func (c *Client) recoverPanic(goroutine string) {
+	if err := recover(); err != nil {
+		c.manager.logger.Error("client goroutine panicked", "client", c.id, "goroutine", goroutine, "panic", err, "stack", string(debug.Stack()))
+		closeWith(c, websocket.CloseInternalServerErr, "internal server error")
+	}
+}
+
+// closeWith sets the close frame telling the client why it is being
+// disconnected, which write sends right away once the client's context
+// is cancelled. The first close frame set wins, so a more specific
+// reason given earlier is kept over the generic one write falls back to.
+func closeWith(c *Client, code int, reason string) {
+	c.closing.CompareAndSwap(nil, &closeFrame{message: websocket.FormatCloseMessage(code, reason)})
+}
+
+// closeAfterDrain is like closeWith, except that write first flushes
+// the messages still queued for the client.
+func (c *Client) closeAfterDrain(code int, reason string) {
+	c.closing.CompareAndSwap(nil, &closeFrame{message: websocket.FormatCloseMessage(code, reason), drain: true})
+}
+
+// writeFrame writes a single frame with a deadline. With compression
+// negotiated only frames of at least the compression threshold are
+// compressed, as deflating small ones costs more than it saves.
+func (c *Client) writeFrame(f frame) error {
+	c.socket.EnableWriteCompression(len(f.data) >= c.manager.compressionThreshold)
+	c.socket.SetWriteDeadline(time.Now().Add(writeWait))
+	if err := c.socket.WriteMessage(f.messageType, f.data); err != nil {
+		return err
+	}
+	c.stats.messagesSent.Add(1)
+	c.stats.bytesSent.Add(int64(len(f.data)))
+	return nil
+}
+
+// drain writes the messages still queued for a client that is closing,
+// so a clean disconnect loses nothing. It reports whether all of them were written.
+func (c *Client) drain() bool {
+	for {
+		select {
+		case next := <-c.send:
+			if err := c.writeFrame(next); err != nil {
+				c.handleWriteErr(err)
+				return false
+			}
+		default:
+			return true
+		}
+	}
+}
+
+// batch combines a text frame with the text frames already queued behind
+// it into one frame holding a JSON array of the messages. A binary frame
+// ends the batch and is returned as pending, to be written right after.
+func (c *Client) batch(first frame) (frame, *frame) {
+	messages := [][]byte{first.data}
+	var pending *frame
+	for n := len(c.send); n > 0; n-- {
+		next := <-c.send
+		if next.messageType != first.messageType {
+			pending = &next
+			break
+		}
+		messages = append(messages, next.data)
+	}
+	if len(messages) == 1 {
+		return first, pending
 	}
+	// writeFrame counts the batch as one message, the others are added here.
+	c.stats.messagesSent.Add(int64(len(messages) - 1))
+	return frame{messageType: first.messageType, data: c.codec.Batch(messages)}, pending
 }
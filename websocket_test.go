@@ -0,0 +1,1088 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// testWait is how long tests wait for something that should happen.
+const testWait = 5 * time.Second
+
+// testServer serves a manager over HTTP the way main does.
+type testServer struct {
+	*httptest.Server
+	manager *ClientManager
+}
+
+// newQuietManager returns a manager that logs nothing.
+func newQuietManager() *ClientManager {
+	manager := NewClientManager()
+	manager.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	return manager
+}
+
+// newTestServer starts a manager, changed by configure before it starts
+// if given, and serves it until the test is over.
+func newTestServer(t *testing.T, configure func(*ClientManager)) *testServer {
+	t.Helper()
+	manager := newQuietManager()
+	if configure != nil {
+		configure(manager)
+	}
+	go manager.start()
+	server := httptest.NewServer(manager.handler())
+	t.Cleanup(func() {
+		manager.shutdown()
+		server.Close()
+	})
+	return &testServer{Server: server, manager: manager}
+}
+
+// wsURL is the websocket endpoint with the given query, such as "echo=false".
+func (s *testServer) wsURL(query string) string {
+	url := "ws" + strings.TrimPrefix(s.URL, "http") + "/ws"
+	if query != "" {
+		url += "?" + query
+	}
+	return url
+}
+
+// testClient is a websocket client whose messages are read in the
+// background, so tests can wait for them without corrupting the
+// connection with read deadlines.
+type testClient struct {
+	t        *testing.T
+	conn     *websocket.Conn
+	id       string
+	token    string
+	replayed []Message
+	messages chan Message
+	err      error
+
+	// batches counts the frames that held more than one message, and
+	// pongs the pongs the server answered pings with.
+	batches atomic.Int64
+	pongs   atomic.Int64
+}
+
+// dial connects a client and waits until it has been greeted, keeping the
+// history it was replayed in between.
+func (s *testServer) dial(t *testing.T, query string) *testClient {
+	t.Helper()
+	conn, res, err := websocket.DefaultDialer.Dial(s.wsURL(query), nil)
+	if err != nil {
+		status := 0
+		if res != nil {
+			status = res.StatusCode
+		}
+		t.Fatalf("dialing failed with status %d: %v", status, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	c := &testClient{t: t, conn: conn, messages: make(chan Message, 1024)}
+	conn.SetPongHandler(func(string) error {
+		c.pongs.Add(1)
+		return nil
+	})
+	go c.readLoop()
+	c.id = c.waitFor(ofType(typeHello)).Recipient
+	for {
+		m := c.next()
+		if m.Type == typeToken {
+			c.token = m.Token
+			return c
+		}
+		c.replayed = append(c.replayed, m)
+	}
+}
+
+// readLoop decodes every message, or batch of messages, the client gets
+// until the connection fails, keeping the error.
+func (c *testClient) readLoop() {
+	defer close(c.messages)
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			c.err = err
+			return
+		}
+		var batch []Message
+		if len(data) > 0 && data[0] == '[' {
+			c.batches.Add(1)
+			err = json.Unmarshal(data, &batch)
+		} else {
+			batch = make([]Message, 1)
+			err = json.Unmarshal(data, &batch[0])
+		}
+		if err != nil {
+			c.err = err
+			return
+		}
+		for _, m := range batch {
+			c.messages <- m
+		}
+	}
+}
+
+// send writes a message as JSON.
+func (c *testClient) send(m Message) {
+	c.t.Helper()
+	if err := c.conn.WriteJSON(m); err != nil {
+		c.t.Fatalf("sending %+v failed: %v", m, err)
+	}
+}
+
+// say sends a chat message.
+func (c *testClient) say(content string) {
+	c.t.Helper()
+	c.send(Message{Content: content})
+}
+
+// next returns the next message, failing the test if none arrives.
+func (c *testClient) next() Message {
+	c.t.Helper()
+	select {
+	case m, ok := <-c.messages:
+		if !ok {
+			c.t.Fatalf("connection of %s closed: %v", c.id, c.err)
+		}
+		return m
+	case <-time.After(testWait):
+		c.t.Fatalf("%s got no message within %v", c.id, testWait)
+	}
+	return Message{}
+}
+
+// waitFor skips messages until one matches.
+func (c *testClient) waitFor(match func(Message) bool) Message {
+	c.t.Helper()
+	for {
+		if m := c.next(); match(m) {
+			return m
+		}
+	}
+}
+
+// expectNone fails the test if a matching message arrives within d.
+func (c *testClient) expectNone(match func(Message) bool, d time.Duration) {
+	c.t.Helper()
+	timeout := time.After(d)
+	for {
+		select {
+		case m, ok := <-c.messages:
+			if !ok {
+				return
+			}
+			if match(m) {
+				c.t.Fatalf("%s got unexpected %+v", c.id, m)
+			}
+		case <-timeout:
+			return
+		}
+	}
+}
+
+// waitClosed skips messages until the connection is closed and returns
+// the error reading failed with, such as a *websocket.CloseError.
+func (c *testClient) waitClosed() error {
+	c.t.Helper()
+	timeout := time.After(testWait)
+	for {
+		select {
+		case _, ok := <-c.messages:
+			if !ok {
+				return c.err
+			}
+		case <-timeout:
+			c.t.Fatalf("connection of %s still open after %v", c.id, testWait)
+		}
+	}
+}
+
+// ofType matches messages of the given type.
+func ofType(kind string) func(Message) bool {
+	return func(m Message) bool { return m.Type == kind }
+}
+
+// event matches presence events of the given type about the client id.
+func event(kind, id string) func(Message) bool {
+	return func(m Message) bool { return m.Type == kind && m.Sender == id }
+}
+
+// joined matches the event of the client id joining room.
+func joined(id, room string) func(Message) bool {
+	return func(m Message) bool { return m.Type == typeJoin && m.Sender == id && m.Room == room }
+}
+
+// chat matches the chat message with the given content.
+func chat(content string) func(Message) bool {
+	return func(m Message) bool { return m.Type == "" && m.Content == content }
+}
+
+// eventually fails the test unless cond holds within testWait.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(testWait)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s did not happen within %v", what, testWait)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// idleForTest reports whether the manager has let go of every client.
+func (manager *ClientManager) idleForTest() bool {
+	manager.mu.RLock()
+	defer manager.mu.RUnlock()
+	return len(manager.clients) == 0 && len(manager.rooms) == 0 && len(manager.users) == 0
+}
+
+func TestMessagesReachOtherClients(t *testing.T) {
+	server := newTestServer(t, nil)
+	alice, bob := server.dial(t, ""), server.dial(t, "")
+
+	alice.say("hello bob")
+	got := bob.waitFor(chat("hello bob"))
+	if got.Sender != alice.id || got.Room != defaultRoom {
+		t.Errorf("bob got %+v, want a message from %s in %s", got, alice.id, defaultRoom)
+	}
+	bob.say("hi alice")
+	if got := alice.waitFor(chat("hi alice")); got.Sender != bob.id {
+		t.Errorf("alice got %+v, want a message from %s", got, bob.id)
+	}
+}
+
+func TestJoinAndLeaveEvents(t *testing.T) {
+	server := newTestServer(t, nil)
+	alice := server.dial(t, "")
+	bob := server.dial(t, "")
+
+	if join := alice.waitFor(event(typeJoin, bob.id)); join.Room != defaultRoom {
+		t.Errorf("alice got %+v, want bob joining %s", join, defaultRoom)
+	}
+	bob.conn.Close()
+	if leave := alice.waitFor(event(typeLeave, bob.id)); leave.Room != defaultRoom {
+		t.Errorf("alice got %+v, want bob leaving %s", leave, defaultRoom)
+	}
+}
+
+func TestDisconnectCleansUp(t *testing.T) {
+	server := newTestServer(t, nil)
+	alice, bob := server.dial(t, ""), server.dial(t, "")
+	alice.send(Message{Content: "/join elsewhere"})
+	alice.waitFor(joined(alice.id, "elsewhere"))
+
+	alice.conn.Close()
+	bob.conn.Close()
+	eventually(t, "removing the clients and their rooms", server.manager.idleForTest)
+	if stats := server.manager.stats(); stats.Clients != 0 {
+		t.Errorf("stats report %d clients after everyone left", stats.Clients)
+	}
+}
+
+func TestProtectedHistoryGoesWithThePassword(t *testing.T) {
+	db, err := openSQLiteStore(filepath.Join(t.TempDir(), "chat.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newAsyncStore(db, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	t.Cleanup(func() { store.Close() })
+	server := newTestServer(t, func(manager *ClientManager) { manager.store = store })
+
+	alice := server.dial(t, "")
+	alice.send(Message{Content: "/join secret hunter2"})
+	alice.waitFor(joined(alice.id, "secret"))
+	alice.say("classified")
+	alice.waitFor(chat("classified"))
+	alice.conn.Close()
+	eventually(t, "alice leaving", server.manager.idleForTest)
+
+	bob := server.dial(t, "")
+	bob.send(Message{Content: "/join secret guessed"})
+	for {
+		m := bob.next()
+		if chat("classified")(m) {
+			t.Fatalf("bob was replayed %+v from the protected room", m)
+		}
+		if joined(bob.id, "secret")(m) {
+			break
+		}
+	}
+	eventually(t, "clearing the persisted history", func() bool {
+		page, err := store.Page("secret", "", maxHistoryPage)
+		return err == nil && len(page) == 0
+	})
+}
+
+func TestEmptyRoomsAreReplayedFromTheStore(t *testing.T) {
+	server := newTestServer(t, func(manager *ClientManager) { manager.store = &memoryStore{} })
+
+	alice := server.dial(t, "")
+	alice.send(Message{Content: "/join side"})
+	alice.waitFor(joined(alice.id, "side"))
+	alice.say("remember me")
+	alice.waitFor(chat("remember me"))
+	alice.conn.Close()
+	eventually(t, "alice leaving", server.manager.idleForTest)
+	server.manager.mu.RLock()
+	kept := len(server.manager.history)
+	server.manager.mu.RUnlock()
+	if kept != 0 {
+		t.Fatalf("%d rooms nobody is in still have history in memory", kept)
+	}
+
+	bob := server.dial(t, "")
+	bob.send(Message{Content: "/join side"})
+	bob.waitFor(chat("remember me"))
+}
+
+func TestPresenceOfUsersWithSeveralConnections(t *testing.T) {
+	server := newTestServer(t, func(manager *ClientManager) {
+		manager.authenticate = tokenAuthenticator(map[string]string{"a": "alice", "b": "bob"})
+	})
+	bob := server.dial(t, "access_token=b")
+	bob.send(Message{Content: "/subscribe side"})
+	bob.waitFor(joined(bob.id, "side"))
+
+	tab := server.dial(t, "access_token=a")
+	bob.waitFor(joined("alice", defaultRoom))
+	other := server.dial(t, "access_token=a")
+	other.send(Message{Content: "/join side"})
+	for {
+		m := bob.next()
+		if m.Sender == "alice" && m.Room == defaultRoom {
+			t.Fatalf("bob got %+v although alice is still in %s", m, defaultRoom)
+		}
+		if joined("alice", "side")(m) {
+			break
+		}
+	}
+
+	other.conn.Close()
+	if leave := bob.waitFor(event(typeLeave, "alice")); leave.Room != "side" {
+		t.Errorf("bob got %+v, want alice leaving side", leave)
+	}
+	tab.conn.Close()
+	if leave := bob.waitFor(event(typeLeave, "alice")); leave.Room != defaultRoom {
+		t.Errorf("bob got %+v, want alice leaving %s", leave, defaultRoom)
+	}
+}
+
+func TestIdleClientsAreDropped(t *testing.T) {
+	server := newTestServer(t, func(manager *ClientManager) { manager.idleTimeout = 300 * time.Millisecond })
+	idle, ponging := server.dial(t, ""), server.dial(t, "")
+	active, pinging := server.dial(t, ""), server.dial(t, "")
+
+	// Pongs only answer our pings, so sending nothing but pongs is idle.
+	deadline := time.Now().Add(600 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		active.say("still here")
+		ponging.conn.WriteControl(websocket.PongMessage, nil, time.Now().Add(time.Second))
+		if err := pinging.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second)); err != nil {
+			t.Fatalf("pinging failed: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	for _, c := range []*testClient{idle, ponging} {
+		var closed *websocket.CloseError
+		if err := c.waitClosed(); !errors.As(err, &closed) || closed.Code != websocket.ClosePolicyViolation {
+			t.Errorf("idle client was closed with %v, want %d", err, websocket.ClosePolicyViolation)
+		}
+	}
+	active.say("done")
+	active.waitFor(chat("done"))
+	pinging.waitFor(chat("done"))
+}
+
+func TestErrorsOnlyReachTheConnectionAtFault(t *testing.T) {
+	server := newTestServer(t, func(manager *ClientManager) {
+		manager.authenticate = tokenAuthenticator(map[string]string{"a": "alice", "b": "bob"})
+	})
+	tab, other := server.dial(t, "access_token=a"), server.dial(t, "access_token=a")
+	server.dial(t, "access_token=b")
+
+	tab.send(Message{Type: typeEdit, ID: "missing", Content: "fixed"})
+	if got := tab.waitFor(ofType(typeError)); got.Code != codeNotFound {
+		t.Errorf("editing an unknown message failed with %+v, want %s", got, codeNotFound)
+	}
+	tab.send(Message{Recipient: "bob", Content: "psst"})
+	tab.waitFor(ofType(typeAck))
+	other.expectNone(func(m Message) bool { return m.Type == typeError || m.Type == typeAck }, 200*time.Millisecond)
+}
+
+func TestRegisterAndUnregisterConcurrently(t *testing.T) {
+	server := newTestServer(t, nil)
+	watcher := server.dial(t, "")
+
+	done := make(chan error)
+	for i := 0; i < 20; i++ {
+		go func() {
+			for j := 0; j < 5; j++ {
+				conn, _, err := websocket.DefaultDialer.Dial(server.wsURL(""), nil)
+				if err != nil {
+					done <- err
+					return
+				}
+				conn.WriteJSON(Message{Content: "hi"})
+				conn.Close()
+			}
+			done <- nil
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	watcher.conn.Close()
+	eventually(t, "unregistering everyone", server.manager.idleForTest)
+}
+
+func TestOversizedFramesCloseTheConnection(t *testing.T) {
+	server := newTestServer(t, nil)
+	client := server.dial(t, "")
+
+	client.say(strings.Repeat("x", maxMessageSize+1))
+	var closed *websocket.CloseError
+	if err := client.waitClosed(); !errors.As(err, &closed) || closed.Code != websocket.CloseMessageTooBig {
+		t.Errorf("oversized frame closed the connection with %v, want %d", err, websocket.CloseMessageTooBig)
+	}
+	eventually(t, "unregistering the client", server.manager.idleForTest)
+}
+
+func TestReadErrorsDoNotTakeTheServerDown(t *testing.T) {
+	server := newTestServer(t, nil)
+	broken, bystander := server.dial(t, ""), server.dial(t, "")
+
+	// Clients must mask their frames, so an unmasked one fails the read.
+	if _, err := broken.conn.UnderlyingConn().Write([]byte{0x81, 0x05, 'h', 'e', 'l', 'l', 'o'}); err != nil {
+		t.Fatal(err)
+	}
+	broken.waitClosed()
+	bystander.waitFor(event(typeLeave, broken.id))
+
+	later := server.dial(t, "")
+	later.say("still up")
+	bystander.waitFor(chat("still up"))
+}
+
+func TestBurstsAreRateLimited(t *testing.T) {
+	server := newTestServer(t, nil)
+	client := server.dial(t, "")
+
+	const sent = 3 * defaultMessageBurst
+	for i := 0; i < sent; i++ {
+		client.say("spam")
+	}
+	limited, delivered := 0, 0
+	for {
+		m := client.next()
+		if m.Type == typeError && m.Code == codeRateLimited {
+			limited++
+		}
+		if chat("spam")(m) {
+			delivered++
+		}
+		if limited+delivered == sent {
+			break
+		}
+	}
+	if limited == 0 || delivered < defaultMessageBurst || delivered == sent {
+		t.Errorf("%d of a burst of %d messages were delivered and %d rate limited", delivered, sent, limited)
+	}
+}
+
+// clientByID returns the connection of the client with the given id.
+func (manager *ClientManager) clientByID(t *testing.T, id string) *Client {
+	t.Helper()
+	manager.mu.RLock()
+	defer manager.mu.RUnlock()
+	conns := manager.connectionsFor(id)
+	if len(conns) == 0 {
+		t.Fatalf("no client %s is registered", id)
+	}
+	return conns[0]
+}
+
+func TestCancellingAClientStopsBothLoops(t *testing.T) {
+	server := newTestServer(t, nil)
+	client := server.dial(t, "")
+
+	server.manager.clientByID(t, client.id).cancel()
+	stopped := make(chan struct{})
+	go func() {
+		server.manager.writers.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(testWait):
+		t.Fatal("the write loop is still running after cancelling the client")
+	}
+	client.waitClosed()
+	eventually(t, "the read loop unregistering the client", server.manager.idleForTest)
+}
+
+func TestBatchingUnderLoad(t *testing.T) {
+	server := newTestServer(t, func(manager *ClientManager) { manager.messageRate = 0 })
+	sender, receiver := server.dial(t, "echo=false"), server.dial(t, "")
+	before := receiver.batches.Load()
+
+	// Fewer messages than fit in the send queue, so none is dropped.
+	const sent = sendBufferSize / 2
+	for i := 0; i < sent; i++ {
+		sender.say(strconv.Itoa(i))
+	}
+	for i := 0; i < sent; i++ {
+		if m := receiver.waitFor(ofType("")); m.Content != strconv.Itoa(i) {
+			t.Fatalf("message %d arrived as %q", i, m.Content)
+		}
+	}
+	if receiver.batches.Load() == before {
+		t.Errorf("none of %d messages sent in a row were batched", sent)
+	}
+}
+
+func TestBatchCombinesQueuedTextFrames(t *testing.T) {
+	client := &Client{codec: jsonCodec{}, send: make(chan frame, 4)}
+	client.send <- frame{messageType: websocket.TextMessage, data: []byte(`{"content":"2"}`)}
+	client.send <- frame{messageType: websocket.BinaryMessage, data: []byte{1}}
+	client.send <- frame{messageType: websocket.TextMessage, data: []byte(`{"content":"3"}`)}
+
+	batch, pending := client.batch(frame{messageType: websocket.TextMessage, data: []byte(`{"content":"1"}`)})
+	if string(batch.data) != `[{"content":"1"},{"content":"2"}]` {
+		t.Errorf("batch holds %s, want the first two messages", batch.data)
+	}
+	if pending == nil || pending.messageType != websocket.BinaryMessage {
+		t.Errorf("batch left %+v pending, want the binary frame", pending)
+	}
+	if len(client.send) != 1 {
+		t.Errorf("%d frames are left queued, want the one after the binary frame", len(client.send))
+	}
+}
+
+func TestPlainRequestsAreNotUpgraded(t *testing.T) {
+	server := newTestServer(t, nil)
+	res, err := http.Get(server.URL + "/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("GET /ws responded with %d, want %d", res.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestFullServersTurnClientsAway(t *testing.T) {
+	server := newTestServer(t, func(manager *ClientManager) { manager.maxClients = 2 })
+	server.dial(t, "")
+	server.dial(t, "")
+
+	_, res, err := websocket.DefaultDialer.Dial(server.wsURL(""), nil)
+	if err == nil || res.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("the third client got %v, want %d", err, http.StatusServiceUnavailable)
+	}
+	if got, want := res.Header.Get("Retry-After"), strconv.Itoa(int(retryAfter/time.Second)); got != want {
+		t.Errorf("Retry-After is %q, want %q", got, want)
+	}
+}
+
+// dialStalled connects a client that reads nothing after its greeting,
+// with a receive buffer small enough for the server to fill it soon.
+func (s *testServer) dialStalled(t *testing.T) string {
+	t.Helper()
+	dialer := websocket.Dialer{NetDial: func(network, addr string) (net.Conn, error) {
+		conn, err := net.Dial(network, addr)
+		if err == nil {
+			conn.(*net.TCPConn).SetReadBuffer(1024)
+		}
+		return conn, err
+	}}
+	conn, _, err := dialer.Dial(s.wsURL(""), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var greeting []Message
+	if err := json.Unmarshal(data, &greeting); err != nil {
+		greeting = make([]Message, 1)
+		json.Unmarshal(data, &greeting[0])
+	}
+	return greeting[0].Recipient
+}
+
+func TestStalledRecipientsAreDropped(t *testing.T) {
+	server := newTestServer(t, func(manager *ClientManager) { manager.messageRate = 0 })
+	stalled := server.dialStalled(t)
+	sender, bystander := server.dial(t, "echo=false"), server.dial(t, "")
+
+	// The sender waits for the acks of each round of messages before the
+	// next, so only the stalled client falls behind, until a nack says it
+	// is not keeping up.
+	message := Message{Recipient: stalled, Content: strings.Repeat("x", maxContentLength)}
+	deadline := time.Now().Add(testWait)
+	for nacked := false; !nacked; {
+		if time.Now().After(deadline) {
+			t.Fatal("direct messages to a stalled client were still queued after", testWait)
+		}
+		for i := 0; i < 20; i++ {
+			sender.send(message)
+		}
+		for i := 0; i < 20; i++ {
+			if sender.waitFor(func(m Message) bool { return m.Type == typeAck || m.Type == typeNack }).Type == typeNack {
+				nacked = true
+			}
+		}
+	}
+	eventually(t, "dropping the stalled client", func() bool {
+		server.manager.mu.RLock()
+		defer server.manager.mu.RUnlock()
+		return len(server.manager.connectionsFor(stalled)) == 0
+	})
+
+	sender.say("everyone else still hears me")
+	bystander.waitFor(chat("everyone else still hears me"))
+}
+
+func TestWhispersStayPrivate(t *testing.T) {
+	server := newTestServer(t, nil)
+	alice, bob, carol := server.dial(t, ""), server.dial(t, ""), server.dial(t, "")
+
+	alice.say("/whisper " + bob.id + " psst")
+	if got := bob.waitFor(ofType(typeWhisper)); got.Content != "psst" || got.Sender != alice.id {
+		t.Errorf("bob got %+v, want alice whispering psst", got)
+	}
+	alice.say("after the whisper")
+	for {
+		m := carol.next()
+		if m.Content == "psst" {
+			t.Fatalf("carol overheard %+v", m)
+		}
+		if chat("after the whisper")(m) {
+			break
+		}
+	}
+
+	for _, m := range server.dial(t, "").replayed {
+		if m.Content == "psst" {
+			t.Errorf("the whisper was replayed as %+v", m)
+		}
+	}
+	server.manager.mu.RLock()
+	defer server.manager.mu.RUnlock()
+	for _, m := range server.manager.history[defaultRoom] {
+		if m.Content == "psst" {
+			t.Errorf("the whisper was kept in history as %+v", m)
+		}
+	}
+}
+
+func TestPingsAndMessagesConcurrently(t *testing.T) {
+	server := newTestServer(t, func(manager *ClientManager) { manager.messageRate = 0 })
+	client := server.dial(t, "")
+
+	const sent = 100
+	pinged := make(chan error)
+	go func() {
+		for i := 0; i < sent; i++ {
+			if err := client.conn.WriteControl(websocket.PingMessage, []byte(strconv.Itoa(i)), time.Now().Add(time.Second)); err != nil {
+				pinged <- err
+				return
+			}
+		}
+		pinged <- nil
+	}()
+	for i := 0; i < sent; i++ {
+		client.say(strconv.Itoa(i))
+	}
+	if err := <-pinged; err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < sent; i++ {
+		if m := client.waitFor(ofType("")); m.Content != strconv.Itoa(i) {
+			t.Fatalf("message %d arrived as %q", i, m.Content)
+		}
+	}
+	eventually(t, "answering every ping", func() bool { return client.pongs.Load() == sent })
+}
+
+func TestPanicsOnlyCloseTheClient(t *testing.T) {
+	server := newTestServer(t, func(manager *ClientManager) {
+		manager.Handle("boom", "/boom", func(c *Client, m *Message, args []string) error {
+			panic("boom")
+		}, 0, false)
+	})
+	client, bystander := server.dial(t, ""), server.dial(t, "")
+
+	client.say("/boom")
+	var closed *websocket.CloseError
+	if err := client.waitClosed(); !errors.As(err, &closed) || closed.Code != websocket.CloseInternalServerErr {
+		t.Errorf("panicking closed the connection with %v, want %d", err, websocket.CloseInternalServerErr)
+	}
+	later := server.dial(t, "")
+	later.say("still up")
+	bystander.waitFor(chat("still up"))
+}
+
+func TestEverySenderIsDeliveredInOrder(t *testing.T) {
+	server := newTestServer(t, func(manager *ClientManager) { manager.messageRate = 0 })
+	senders := []*testClient{server.dial(t, ""), server.dial(t, "")}
+	recipients := append([]*testClient{server.dial(t, ""), server.dial(t, "")}, senders...)
+
+	// Both senders together stay below the send queue, so nothing is dropped.
+	const sent = sendBufferSize / 3
+	done := make(chan error)
+	for _, sender := range senders {
+		go func(conn *websocket.Conn) {
+			for i := 0; i < sent; i++ {
+				if err := conn.WriteJSON(Message{Content: strconv.Itoa(i)}); err != nil {
+					done <- err
+					return
+				}
+			}
+			done <- nil
+		}(sender.conn)
+	}
+	for range senders {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, recipient := range recipients {
+		next := make(map[string]int)
+		for i := 0; i < len(senders)*sent; i++ {
+			m := recipient.waitFor(ofType(""))
+			if m.Content != strconv.Itoa(next[m.Sender]) {
+				t.Fatalf("%s got message %s of %s after %d others", recipient.id, m.Content, m.Sender, next[m.Sender])
+			}
+			next[m.Sender]++
+		}
+	}
+}
+
+func TestSpectatorsAreNotRelayed(t *testing.T) {
+	server := newTestServer(t, nil)
+	spectator, listener := server.dial(t, "spectate=true"), server.dial(t, "")
+
+	spectator.say("can you hear me")
+	listener.expectNone(chat("can you hear me"), 200*time.Millisecond)
+	listener.say("I can")
+	spectator.waitFor(chat("I can"))
+}
+
+func TestSendersGetTheirOwnMessagesAsConfigured(t *testing.T) {
+	tests := []struct {
+		includeSender bool
+		query         string
+		want          bool
+	}{
+		{true, "", true},
+		{true, "echo=false", false},
+		{false, "", false},
+		{false, "echo=true", true},
+	}
+	for _, test := range tests {
+		server := newTestServer(t, func(manager *ClientManager) { manager.includeSender = test.includeSender })
+		sender, listener := server.dial(t, test.query), server.dial(t, "")
+
+		sender.say("echo?")
+		listener.waitFor(chat("echo?"))
+		// Binary frames are relayed untouched, so one holding JSON reads
+		// like any other message.
+		if err := sender.conn.WriteMessage(websocket.BinaryMessage, []byte(`{"content":"binary echo?"}`)); err != nil {
+			t.Fatal(err)
+		}
+		listener.waitFor(chat("binary echo?"))
+		listener.say("echo done")
+		echoed, binaryEchoed := false, false
+		for m := sender.waitFor(ofType("")); m.Content != "echo done"; m = sender.waitFor(ofType("")) {
+			echoed = echoed || m.Content == "echo?"
+			binaryEchoed = binaryEchoed || m.Content == "binary echo?"
+		}
+		if echoed != test.want {
+			t.Errorf("with include-sender %v and %q the sender got its message back: %v, want %v", test.includeSender, test.query, echoed, test.want)
+		}
+		if binaryEchoed != test.want {
+			t.Errorf("with include-sender %v and %q the sender got its binary frame back: %v, want %v", test.includeSender, test.query, binaryEchoed, test.want)
+		}
+	}
+}
+
+func TestRetriedMessagesAreDeliveredOnce(t *testing.T) {
+	server := newTestServer(t, nil)
+	sender, listener := server.dial(t, "echo=false"), server.dial(t, "")
+
+	sender.send(Message{Content: "once", ClientMsgID: "k1"})
+	sender.send(Message{Content: "once", ClientMsgID: "k1"})
+	first, second := sender.waitFor(ofType(typeAck)), sender.waitFor(ofType(typeAck))
+	if first.ClientMsgID != "k1" || first.ID == "" || second.ID != first.ID {
+		t.Errorf("the acks were %+v and %+v, want both for k1 with the same id", first, second)
+	}
+
+	sender.say("after")
+	delivered := 0
+	for m := listener.waitFor(ofType("")); m.Content != "after"; m = listener.waitFor(ofType("")) {
+		delivered++
+	}
+	if delivered != 1 {
+		t.Errorf("the message was delivered %d times, want once", delivered)
+	}
+}
+
+func TestConnectStormsLeakNothing(t *testing.T) {
+	server := newTestServer(t, nil)
+	baseline := runtime.NumGoroutine()
+
+	for i := 0; i < 200; i++ {
+		conn, _, err := websocket.DefaultDialer.Dial(server.wsURL(""), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	eventually(t, "unregistering every client", server.manager.idleForTest)
+	eventually(t, "stopping every client goroutine", func() bool { return runtime.NumGoroutine() <= baseline })
+	if stats := server.manager.stats(); stats.Clients != 0 || len(stats.Rooms) != 0 {
+		t.Errorf("stats report %+v after every client left", stats)
+	}
+}
+
+// fullClient registers a client whose send queue holds the frames "1"
+// and "2" and has no room for more.
+func fullClient(manager *ClientManager) *Client {
+	ctx, cancel := context.WithCancel(context.Background())
+	conn := &Client{manager: manager, ctx: ctx, cancel: cancel, id: "slow", rooms: map[string]bool{}, send: make(chan frame, 2)}
+	manager.clients[conn] = true
+	manager.users[conn.id] = []*Client{conn}
+	conn.send <- frame{data: []byte("1")}
+	conn.send <- frame{data: []byte("2")}
+	return conn
+}
+
+// queued empties the send queue of conn and returns what it held.
+func queued(conn *Client) string {
+	var frames []string
+	for len(conn.send) > 0 {
+		frames = append(frames, string((<-conn.send).data))
+	}
+	return strings.Join(frames, ",")
+}
+
+func TestOverflowPolicies(t *testing.T) {
+	tests := []struct {
+		policy string
+		pushed bool
+		queue  string
+	}{
+		{overflowDropNewest, false, "1,2"},
+		{overflowDropOldest, true, "2,3"},
+		{overflowDisconnect, false, "1,2"},
+	}
+	for _, test := range tests {
+		manager := newQuietManager()
+		manager.overflowPolicy = test.policy
+		conn := fullClient(manager)
+
+		manager.mu.Lock()
+		pushed := manager.push(conn, frame{data: []byte("3")})
+		_, registered := manager.clients[conn]
+		manager.mu.Unlock()
+		if pushed != test.pushed || !registered {
+			t.Errorf("%s: push into a full queue = %v, registered %v, want %v, true", test.policy, pushed, registered, test.pushed)
+		}
+		if got := queued(conn); got != test.queue {
+			t.Errorf("%s: the queue holds %s, want %s", test.policy, got, test.queue)
+		}
+	}
+}
+
+func TestOverflowDisconnectsClientsThatStayFull(t *testing.T) {
+	manager := newQuietManager()
+	conn := fullClient(manager)
+
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	for i := 1; i <= manager.slowThreshold; i++ {
+		if manager.push(conn, frame{data: []byte("3")}) {
+			t.Fatal("push into a full queue succeeded")
+		}
+		if _, registered := manager.clients[conn]; registered != (i < manager.slowThreshold) {
+			t.Fatalf("after %d failed pushes the client is registered: %v", i, registered)
+		}
+	}
+	if conn.ctx.Err() == nil {
+		t.Error("the dropped client was not cancelled")
+	}
+}
+
+func TestServerOnlyFieldsCannotBeForged(t *testing.T) {
+	server := newTestServer(t, nil)
+	alice, bob := server.dial(t, ""), server.dial(t, "")
+
+	forged := `{"content":"vote","reactions":{"👍":["carol","dave"]},"status":"away","code":"forbidden","token":"x","version":"9","retry_after":5,"removed":true,"old_room":"x","clients":[{"id":"carol"}],"rooms":{"x":1},"history":[{"content":"old"}],"features":["x"]}`
+	if err := alice.conn.WriteMessage(websocket.TextMessage, []byte(forged)); err != nil {
+		t.Fatal(err)
+	}
+	clean := func(m Message) {
+		t.Helper()
+		if m.Reactions != nil || m.Status != "" || m.Code != "" || m.Token != "" || m.Version != "" || m.RetryAfter != 0 ||
+			m.Removed || m.OldRoom != "" || m.Clients != nil || m.Rooms != nil || m.History != nil || m.Features != nil {
+			t.Errorf("got %+v with fields only the server sets", m)
+		}
+	}
+	clean(bob.waitFor(chat("vote")))
+
+	carol := server.dial(t, "")
+	replayed := false
+	for _, m := range carol.replayed {
+		if chat("vote")(m) {
+			replayed = true
+			clean(m)
+		}
+	}
+	if !replayed {
+		t.Error("the message was not kept in history")
+	}
+}
+
+func TestMutesSurviveReconnecting(t *testing.T) {
+	server := newTestServer(t, func(manager *ClientManager) { manager.adminToken = "root" })
+	admin, alice := server.dial(t, "admin_token=root"), server.dial(t, "")
+
+	admin.say("/mute " + alice.id + " 1m")
+	alice.waitFor(chat("/You have been muted for 1m0s."))
+	alice.conn.Close()
+	eventually(t, "remembering the session", func() bool {
+		server.manager.mu.RLock()
+		defer server.manager.mu.RUnlock()
+		_, ok := server.manager.sessions[alice.id]
+		return ok
+	})
+
+	resumed := server.dial(t, "token="+alice.token)
+	if resumed.id != alice.id {
+		t.Fatalf("resuming gave id %s, want %s", resumed.id, alice.id)
+	}
+	resumed.say("still here")
+	admin.expectNone(chat("still here"), 200*time.Millisecond)
+}
+
+func TestOnlyRoomMessagesMayHaveATTL(t *testing.T) {
+	server := newTestServer(t, nil)
+	alice, bob := server.dial(t, ""), server.dial(t, "")
+
+	alice.send(Message{Content: "gone soon", Recipient: bob.id, TTL: 60})
+	if got := alice.waitFor(ofType(typeError)); got.Code != codeBadMessage {
+		t.Errorf("alice got %+v, want a %s error", got, codeBadMessage)
+	}
+	bob.expectNone(chat("gone soon"), 200*time.Millisecond)
+
+	alice.send(Message{Content: "gone later", TTL: 60})
+	if got := bob.waitFor(chat("gone later")); got.TTL != 60 {
+		t.Errorf("bob got %+v, want a ttl of 60", got)
+	}
+}
+
+func TestDirectMessageReceiptsCarryTheClientMsgID(t *testing.T) {
+	server := newTestServer(t, nil)
+	alice, bob := server.dial(t, ""), server.dial(t, "")
+
+	alice.send(Message{Content: "psst", Recipient: bob.id, ClientMsgID: "k1"})
+	if first := alice.waitFor(func(m Message) bool { return chat("psst")(m) || m.Type == typeAck }); first.Type == typeAck {
+		t.Fatalf("alice got the ack %+v before the echo", first)
+	}
+	ack := alice.waitFor(ofType(typeAck))
+	if ack.ClientMsgID != "k1" || ack.Recipient != bob.id {
+		t.Errorf("alice got %+v, want an ack of k1 for %s", ack, bob.id)
+	}
+	alice.expectNone(ofType(typeAck), 200*time.Millisecond)
+
+	quiet := server.dial(t, "echo=false")
+	quiet.send(Message{Content: "hello?", Recipients: []string{bob.id, "nobody"}, ClientMsgID: "k2"})
+	for i := 0; i < 2; i++ {
+		got := quiet.waitFor(func(m Message) bool { return m.Type == typeAck || m.Type == typeNack })
+		if got.ClientMsgID != "k2" {
+			t.Errorf("quiet got %+v, want it to carry k2", got)
+		}
+	}
+}
+
+// countingConn counts the bytes read from a connection, so tests can tell
+// what went over the wire.
+type countingConn struct {
+	net.Conn
+	read *atomic.Int64
+}
+
+func (c countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+func TestLargeMessagesAreSentCompressed(t *testing.T) {
+	const threshold = 512
+	server := newTestServer(t, func(manager *ClientManager) {
+		manager.upgrader.EnableCompression = true
+		manager.compressionThreshold = threshold
+	})
+	sender := server.dial(t, "")
+
+	var read atomic.Int64
+	dialer := websocket.Dialer{
+		EnableCompression: true,
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+			return countingConn{Conn: conn, read: &read}, err
+		},
+	}
+	conn, _, err := dialer.Dial(server.wsURL(""), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	listener := &testClient{t: t, conn: conn, messages: make(chan Message, 1024)}
+	go listener.readLoop()
+	listener.id = listener.waitFor(ofType(typeHello)).Recipient
+	listener.waitFor(joined(listener.id, defaultRoom))
+
+	// wire returns how many bytes the message took to reach the listener
+	// and how long it is encoded.
+	wire := func(content string) (int, int) {
+		t.Helper()
+		before := read.Load()
+		sender.say(content)
+		data, err := json.Marshal(listener.waitFor(chat(content)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return int(read.Load() - before), len(data)
+	}
+	if n, size := wire(strings.Repeat("all work and no play ", maxContentLength/21)); n >= size/2 {
+		t.Errorf("a message of %d bytes took %d bytes on the wire, want it compressed", size, n)
+	}
+	if n, size := wire(strings.Repeat("a", threshold/5)); size >= threshold || n < size {
+		t.Errorf("a message of %d bytes took %d bytes on the wire, want it below the threshold and uncompressed", size, n)
+	}
+}